@@ -0,0 +1,114 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"os"
+	"strconv"
+	"time"
+)
+
+var cramMD5 = Mechanism{
+	Name:        "CRAM-MD5",
+	Properties:  NoPlaintext,
+	ServerFirst: true,
+	Start: func(m *Negotiator) (more bool, resp []byte, cache interface{}, err error) {
+		// Start is only called by servers because CRAM-MD5 is server-first.
+		challenge := cramChallenge(m)
+		return true, challenge, challenge, nil
+	},
+	Next: func(m *Negotiator, challenge []byte, data interface{}) (more bool, resp []byte, cache interface{}, err error) {
+		if m.State()&Receiving == Receiving {
+			return cramServerNext(m, challenge, data)
+		}
+
+		if m.State()&StepMask != Initial {
+			err = ErrTooManySteps
+			return
+		}
+		if len(challenge) == 0 {
+			err = ErrInvalidChallenge
+			return
+		}
+
+		username, password, _ := m.Credentials()
+		return false, cramDigest(username, password, challenge), nil, nil
+	},
+}
+
+// cramDigest returns the client response "username HMAC-MD5(secret, challenge)"
+// as defined by RFC 2195.
+func cramDigest(username, secret, challenge []byte) []byte {
+	h := hmac.New(md5.New, secret)
+	h.Write(challenge)
+	digest := h.Sum(nil)
+
+	resp := make([]byte, len(username)+1+hex.EncodedLen(len(digest)))
+	n := copy(resp, username)
+	resp[n] = ' '
+	hex.Encode(resp[n+1:], digest)
+	return resp
+}
+
+// cramChallenge generates a challenge in the form of an RFC 5322 msg-id
+// containing a random component and a timestamp.
+func cramChallenge(m *Negotiator) []byte {
+	host, err := os.Hostname()
+	if err != nil || host == "" {
+		host = "localhost"
+	}
+
+	challenge := []byte{'<'}
+	challenge = append(challenge, m.Nonce()...)
+	challenge = append(challenge, '.')
+	challenge = strconv.AppendInt(challenge, time.Now().Unix(), 10)
+	challenge = append(challenge, '@')
+	challenge = append(challenge, host...)
+	challenge = append(challenge, '>')
+	return challenge
+}
+
+func cramServerNext(m *Negotiator, challenge []byte, data interface{}) (more bool, resp []byte, cache interface{}, err error) {
+	if m.State()&StepMask != AuthTextSent {
+		err = ErrTooManySteps
+		return
+	}
+	serverChallenge, ok := data.([]byte)
+	if !ok {
+		err = ErrInvalidState
+		return
+	}
+
+	// The response should look like: "username digest" where the digest is 32
+	// lowercase hex digits.
+	idx := bytes.LastIndexByte(challenge, ' ')
+	if idx < 1 || len(challenge)-idx-1 != hex.EncodedLen(md5.Size) {
+		err = ErrInvalidChallenge
+		return
+	}
+	username := challenge[:idx]
+
+	secret, err := m.Secret(username)
+	if err != nil {
+		return false, nil, nil, err
+	}
+	if secret == nil {
+		return false, nil, nil, ErrAuthn
+	}
+	if !hmac.Equal(cramDigest(username, secret, serverChallenge), challenge) {
+		return false, nil, nil, ErrAuthn
+	}
+
+	if m.Permissions(Credentials(func() (Username, Password, Identity []byte) {
+		return username, nil, nil
+	})) {
+		return false, nil, nil, nil
+	}
+	return false, nil, nil, ErrAuthn
+}
@@ -0,0 +1,55 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"bytes"
+	"testing"
+)
+
+func cramSecret(_ *Negotiator, username []byte) ([]byte, error) {
+	if string(username) == "tim" {
+		return []byte("tanstaaftanstaaf"), nil
+	}
+	return nil, nil
+}
+
+func TestCramMD5Server(t *testing.T) {
+	for _, tc := range [...]struct {
+		user, pass string
+		err        error
+	}{
+		{user: "tim", pass: "tanstaaftanstaaf"},
+		{user: "tim", pass: "wrong", err: ErrAuthn},
+		{user: "nobody", pass: "tanstaaftanstaaf", err: ErrAuthn},
+	} {
+		t.Run(tc.user+"/"+tc.pass, func(t *testing.T) {
+			client := NewClient(CramMD5, Credentials(func() ([]byte, []byte, []byte) {
+				return []byte(tc.user), []byte(tc.pass), nil
+			}))
+			server := NewServer(CramMD5, acceptAll, Secret(cramSecret))
+
+			// CRAM-MD5 is server-first, so the server sends the first challenge.
+			more, challenge, err := server.Step(nil)
+			if err != nil || !more {
+				t.Fatalf("Unexpected server challenge: more=%v err=%v", more, err)
+			}
+			if !bytes.HasPrefix(challenge, []byte("<")) || !bytes.HasSuffix(challenge, []byte(">")) {
+				t.Fatalf("Challenge is not a msg-id: %q", challenge)
+			}
+			more, resp, err := client.Step(challenge)
+			if err != nil || more {
+				t.Fatalf("Unexpected client response: more=%v err=%v", more, err)
+			}
+			more, _, err = server.Step(resp)
+			if err != tc.err {
+				t.Fatalf("Unexpected server result: want=%v, got=%v", tc.err, err)
+			}
+			if more {
+				t.Fatalf("Server expected more steps after final response")
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"unicode/utf8"
+)
+
+// digestNC is the nonce count sent by the client. Since each negotiation only
+// ever sends a single response it is always 1.
+const digestNC = "00000001"
+
+var errDigestServer = errors.New("DIGEST-MD5 server not supported")
+
+type digestChallenge struct {
+	realm   []byte
+	nonce   []byte
+	qop     [][]byte
+	charset []byte
+}
+
+func digestMD5(digestURI string) Mechanism {
+	return Mechanism{
+		Name:        "DIGEST-MD5",
+		Properties:  NoPlaintext | MutualAuth | ClientOnly,
+		ServerFirst: true,
+		Start: func(m *Negotiator) (bool, []byte, interface{}, error) {
+			// Start is only called by servers because DIGEST-MD5 is server-first.
+			return false, nil, nil, errDigestServer
+		},
+		Next: func(m *Negotiator, challenge []byte, data interface{}) (more bool, resp []byte, cache interface{}, err error) {
+			if m.State()&Receiving == Receiving {
+				return false, nil, nil, errDigestServer
+			}
+			if len(challenge) == 0 {
+				return false, nil, nil, ErrInvalidChallenge
+			}
+
+			switch m.State() & StepMask {
+			case Initial:
+				return digestClientResponse(m, digestURI, challenge)
+			case AuthTextSent:
+				directives, err := parseDirectives(challenge)
+				if err != nil {
+					return false, nil, nil, err
+				}
+				expected, ok := data.([]byte)
+				if !ok {
+					return false, nil, nil, ErrInvalidState
+				}
+				rspauth := directives["rspauth"]
+				if len(rspauth) != 1 || subtle.ConstantTimeCompare(rspauth[0], expected) != 1 {
+					return false, nil, nil, ErrAuthn
+				}
+				// Success!
+				return false, nil, nil, nil
+			}
+			return false, nil, nil, ErrTooManySteps
+		},
+	}
+}
+
+// digestClientResponse parses the servers digest-challenge and returns the
+// digest-response and the expected value of rspauth.
+func digestClientResponse(m *Negotiator, digestURI string, challenge []byte) (more bool, resp []byte, cache interface{}, err error) {
+	c, err := parseDigestChallenge(challenge)
+	if err != nil {
+		return false, nil, nil, err
+	}
+
+	username, password, identity := m.Credentials()
+	cnonce := m.Nonce()
+	utf8Charset := bytes.EqualFold(c.charset, []byte("utf-8"))
+
+	// If the server supports UTF-8, the username, realm, and password are
+	// converted to ISO 8859-1 before hashing if they can be represented in it.
+	h := md5.New()
+	h.Write(digestLatin1(username, utf8Charset))
+	h.Write([]byte{':'})
+	h.Write(digestLatin1(c.realm, utf8Charset))
+	h.Write([]byte{':'})
+	h.Write(digestLatin1(password, utf8Charset))
+	a1 := h.Sum(nil)
+	a1 = append(a1, ':')
+	a1 = append(a1, c.nonce...)
+	a1 = append(a1, ':')
+	a1 = append(a1, cnonce...)
+	if len(identity) > 0 {
+		a1 = append(a1, ':')
+		a1 = append(a1, identity...)
+	}
+
+	response := digestKD(a1, c.nonce, cnonce, "AUTHENTICATE:"+digestURI)
+	rspauth := digestKD(a1, c.nonce, cnonce, ":"+digestURI)
+
+	if utf8Charset {
+		resp = append(resp, "charset=utf-8,"...)
+	}
+	resp = appendDirective(resp, "username", username, true)
+	if c.realm != nil {
+		resp = appendDirective(resp, "realm", c.realm, true)
+	}
+	resp = appendDirective(resp, "nonce", c.nonce, true)
+	resp = appendDirective(resp, "nc", []byte(digestNC), false)
+	resp = appendDirective(resp, "cnonce", cnonce, true)
+	resp = appendDirective(resp, "digest-uri", []byte(digestURI), true)
+	resp = appendDirective(resp, "response", response, false)
+	resp = appendDirective(resp, "qop", []byte("auth"), false)
+	if len(identity) > 0 {
+		resp = appendDirective(resp, "authzid", identity, true)
+	}
+
+	return true, resp[:len(resp)-1], rspauth, nil
+}
+
+// digestKD computes HEX(KD(HEX(H(A1)), nonce:nc:cnonce:qop:HEX(H(A2)))).
+func digestKD(a1, nonce, cnonce []byte, a2 string) []byte {
+	ha1 := md5.Sum(a1)
+	ha2 := md5.Sum([]byte(a2))
+
+	h := md5.New()
+	h.Write([]byte(hex.EncodeToString(ha1[:])))
+	h.Write([]byte{':'})
+	h.Write(nonce)
+	h.Write([]byte(":" + digestNC + ":"))
+	h.Write(cnonce)
+	h.Write([]byte(":auth:"))
+	h.Write([]byte(hex.EncodeToString(ha2[:])))
+	kd := h.Sum(nil)
+
+	out := make([]byte, hex.EncodedLen(len(kd)))
+	hex.Encode(out, kd)
+	return out
+}
+
+// digestLatin1 converts b from UTF-8 to ISO 8859-1 if convert is true and all
+// of the characters in b can be represented in ISO 8859-1.
+func digestLatin1(b []byte, convert bool) []byte {
+	if !convert || !utf8.Valid(b) {
+		return b
+	}
+	out := make([]byte, 0, len(b))
+	for _, r := range string(b) {
+		if r > 0xff {
+			return b
+		}
+		out = append(out, byte(r))
+	}
+	return out
+}
+
+func parseDigestChallenge(challenge []byte) (c digestChallenge, err error) {
+	directives, err := parseDirectives(challenge)
+	if err != nil {
+		return c, err
+	}
+
+	nonce := directives["nonce"]
+	if len(nonce) != 1 {
+		return c, errors.New("Challenge must contain exactly one nonce")
+	}
+	c.nonce = nonce[0]
+
+	algorithm := directives["algorithm"]
+	if len(algorithm) != 1 || string(algorithm[0]) != "md5-sess" {
+		return c, errors.New("Challenge must specify the md5-sess algorithm")
+	}
+
+	switch charset := directives["charset"]; len(charset) {
+	case 0:
+	case 1:
+		c.charset = charset[0]
+	default:
+		return c, errors.New("Challenge contains multiple charsets")
+	}
+
+	// We always use the first realm offered by the server.
+	if realm := directives["realm"]; len(realm) > 0 {
+		c.realm = realm[0]
+	}
+
+	// If qop is not specified it defaults to "auth".
+	qop := directives["qop"]
+	if len(qop) == 0 {
+		return c, nil
+	}
+	for _, opt := range bytes.Split(qop[0], []byte{','}) {
+		c.qop = append(c.qop, bytes.TrimSpace(opt))
+	}
+	for _, opt := range c.qop {
+		if string(opt) == "auth" {
+			return c, nil
+		}
+	}
+	return c, errors.New("Server does not support qop=auth")
+}
+
+// parseDirectives parses a comma separated list of name=value pairs where
+// value is either a token or a quoted-string as defined in RFC 2831.
+// Directives may appear more than once.
+func parseDirectives(b []byte) (map[string][][]byte, error) {
+	directives := make(map[string][][]byte)
+	for {
+		b = bytes.TrimLeft(b, " \t,")
+		if len(b) == 0 {
+			return directives, nil
+		}
+
+		idx := bytes.IndexByte(b, '=')
+		if idx < 1 {
+			return nil, ErrInvalidChallenge
+		}
+		name := string(bytes.ToLower(bytes.TrimSpace(b[:idx])))
+		b = bytes.TrimLeft(b[idx+1:], " \t")
+
+		var value []byte
+		if len(b) > 0 && b[0] == '"' {
+			value = []byte{}
+			i := 1
+			for ; i < len(b) && b[i] != '"'; i++ {
+				if b[i] == '\\' && i+1 < len(b) {
+					i++
+				}
+				value = append(value, b[i])
+			}
+			if i == len(b) {
+				return nil, ErrInvalidChallenge
+			}
+			b = b[i+1:]
+		} else {
+			idx = bytes.IndexByte(b, ',')
+			if idx < 0 {
+				idx = len(b)
+			}
+			value = bytes.TrimSpace(b[:idx])
+			b = b[idx:]
+		}
+		directives[name] = append(directives[name], value)
+
+		b = bytes.TrimLeft(b, " \t")
+		if len(b) > 0 && b[0] != ',' {
+			return nil, ErrInvalidChallenge
+		}
+	}
+}
+
+// appendDirective appends name=value followed by a comma to b, quoting value
+// if necessary.
+func appendDirective(b []byte, name string, value []byte, quote bool) []byte {
+	b = append(b, name...)
+	b = append(b, '=')
+	if !quote {
+		b = append(b, value...)
+		return append(b, ',')
+	}
+	b = append(b, '"')
+	for _, c := range value {
+		if c == '"' || c == '\\' {
+			b = append(b, '\\')
+		}
+		b = append(b, c)
+	}
+	return append(b, '"', ',')
+}
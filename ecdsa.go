@@ -0,0 +1,141 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"errors"
+	"math/big"
+)
+
+// The length of the challenge sent by ECDSA-NIST256P-CHALLENGE servers.
+const ecdsaChallengeLen = 32
+
+// ECDSAConfig configures the ECDSA-NIST256P-CHALLENGE mechanism.
+type ECDSAConfig struct {
+	// Key is the private key used by clients to sign the challenge.
+	// It must use the NIST P-256 curve.
+	Key *ecdsa.PrivateKey
+
+	// PublicKey is used by servers to look up the public key registered for an
+	// account.
+	// If the account does not exist or has no key it should return a nil key
+	// and a nil error.
+	PublicKey func(n *Negotiator, username []byte) (*ecdsa.PublicKey, error)
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// ecdsaServerState is cached by servers between the challenge and response.
+type ecdsaServerState struct {
+	username  []byte
+	identity  []byte
+	challenge []byte
+}
+
+func ecdsaNIST256PChallenge(c ECDSAConfig) Mechanism {
+	return Mechanism{
+		Name:       "ECDSA-NIST256P-CHALLENGE",
+		Properties: NoPlaintext | NoDictionary,
+		Start: func(m *Negotiator) (more bool, resp []byte, cache interface{}, err error) {
+			username, _, identity := m.Credentials()
+			resp = append(resp, username...)
+			if len(identity) > 0 {
+				resp = append(resp, 0)
+				resp = append(resp, identity...)
+			}
+			return true, resp, nil, nil
+		},
+		Next: func(m *Negotiator, challenge []byte, data interface{}) (more bool, resp []byte, cache interface{}, err error) {
+			if m.State()&Receiving == Receiving {
+				return ecdsaServerNext(c, m, challenge, data)
+			}
+
+			switch m.State() & StepMask {
+			case AuthTextSent:
+				if len(challenge) != ecdsaChallengeLen {
+					return false, nil, nil, ErrInvalidChallenge
+				}
+				key := c.Key
+				if key == nil || key.Curve != elliptic.P256() {
+					return false, nil, nil, errors.New("A NIST P-256 private key is required")
+				}
+				r, s, err := ecdsa.Sign(rand.Reader, key, challenge)
+				if err != nil {
+					return false, nil, nil, err
+				}
+				resp, err = asn1.Marshal(ecdsaSignature{R: r, S: s})
+				return err == nil, resp, nil, err
+			case ResponseSent:
+				// The server does not send any additional data with success.
+				if len(challenge) > 0 {
+					return false, nil, nil, ErrInvalidChallenge
+				}
+				return false, nil, nil, nil
+			}
+			return false, nil, nil, ErrTooManySteps
+		},
+	}
+}
+
+func ecdsaServerNext(c ECDSAConfig, m *Negotiator, challenge []byte, data interface{}) (more bool, resp []byte, cache interface{}, err error) {
+	switch m.State() & StepMask {
+	case AuthTextSent:
+		// The client sends the account name, optionally followed by a NUL byte
+		// and the authorization identity.
+		username, identity := challenge, []byte(nil)
+		if idx := bytes.IndexByte(challenge, 0); idx >= 0 {
+			username, identity = challenge[:idx], challenge[idx+1:]
+		}
+		if len(username) == 0 {
+			return false, nil, nil, ErrInvalidChallenge
+		}
+
+		resp = make([]byte, ecdsaChallengeLen)
+		if _, err = rand.Read(resp); err != nil {
+			return false, nil, nil, err
+		}
+		return true, resp, &ecdsaServerState{
+			username:  username,
+			identity:  identity,
+			challenge: resp,
+		}, nil
+	case ResponseSent:
+		state, ok := data.(*ecdsaServerState)
+		if !ok {
+			return false, nil, nil, ErrInvalidState
+		}
+		var sig ecdsaSignature
+		rest, err := asn1.Unmarshal(challenge, &sig)
+		if err != nil || len(rest) > 0 || sig.R == nil || sig.S == nil {
+			return false, nil, nil, ErrInvalidChallenge
+		}
+
+		if c.PublicKey == nil {
+			return false, nil, nil, ErrAuthn
+		}
+		pub, err := c.PublicKey(m, state.username)
+		if err != nil {
+			return false, nil, nil, err
+		}
+		if pub == nil || pub.Curve != elliptic.P256() || !ecdsa.Verify(pub, state.challenge, sig.R, sig.S) {
+			return false, nil, nil, ErrAuthn
+		}
+
+		if !m.Permissions(Credentials(func() (Username, Password, Identity []byte) {
+			return state.username, nil, state.identity
+		})) {
+			return false, nil, nil, ErrAuthn
+		}
+		return false, nil, nil, nil
+	}
+	return false, nil, nil, ErrTooManySteps
+}
@@ -0,0 +1,122 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"testing"
+)
+
+func TestEcdsaNist256pChallenge(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lookup := func(_ *Negotiator, username []byte) (*ecdsa.PublicKey, error) {
+		switch string(username) {
+		case "jilles":
+			return &key.PublicKey, nil
+		case "p384":
+			return &p384.PublicKey, nil
+		}
+		return nil, nil
+	}
+
+	for _, tc := range [...]struct {
+		name      string
+		user      string
+		identity  string
+		key       *ecdsa.PrivateKey
+		clientErr bool
+		serverErr error
+	}{
+		{name: "Valid", user: "jilles", key: key},
+		{name: "Identity", user: "jilles", identity: "admin", key: key},
+		{name: "WrongKey", user: "jilles", key: other, serverErr: ErrAuthn},
+		{name: "UnknownUser", user: "nobody", key: key, serverErr: ErrAuthn},
+		{name: "WrongCurve", user: "p384", key: p384, clientErr: true},
+		{name: "NoKey", user: "jilles", clientErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			user, identity := tc.user, tc.identity
+			var gotUser, gotIdentity string
+			perm := func(n *Negotiator) bool {
+				u, _, i := n.Credentials()
+				gotUser, gotIdentity = string(u), string(i)
+				return true
+			}
+			client := NewClient(EcdsaNist256pChallenge(ECDSAConfig{Key: tc.key}), Credentials(func() ([]byte, []byte, []byte) {
+				return []byte(user), nil, []byte(identity)
+			}))
+			server := NewServer(EcdsaNist256pChallenge(ECDSAConfig{PublicKey: lookup}), perm)
+
+			clientErr, serverErr := stepPair(client, server)
+			if (clientErr != nil) != tc.clientErr {
+				t.Errorf("Unexpected client error: %v", clientErr)
+			}
+			if serverErr != tc.serverErr {
+				t.Errorf("Unexpected server error: want=%v, got=%v", tc.serverErr, serverErr)
+			}
+			if tc.clientErr || tc.serverErr != nil {
+				return
+			}
+			if gotUser != tc.user || gotIdentity != tc.identity {
+				t.Errorf("Unexpected credentials: want=%q/%q, got=%q/%q", tc.user, tc.identity, gotUser, gotIdentity)
+			}
+		})
+	}
+}
+
+func TestEcdsaNist256pChallengeClient(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(EcdsaNist256pChallenge(ECDSAConfig{Key: key}), Credentials(func() ([]byte, []byte, []byte) {
+		return []byte("jilles"), nil, nil
+	}))
+	_, resp, err := client.Step(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(resp) != "jilles" {
+		t.Errorf("Unexpected initial response: %q", resp)
+	}
+
+	challenge := make([]byte, 32)
+	for i := range challenge {
+		challenge[i] = byte(i)
+	}
+	more, resp, err := client.Step(challenge)
+	if err != nil || !more {
+		t.Fatalf("Unexpected result signing challenge: more=%v, err=%v", more, err)
+	}
+	var sig ecdsaSignature
+	if _, err = asn1.Unmarshal(resp, &sig); err != nil {
+		t.Fatalf("Signature is not valid ASN.1: %v", err)
+	}
+	if !ecdsa.Verify(&key.PublicKey, challenge, sig.R, sig.S) {
+		t.Error("Signature does not verify")
+	}
+
+	client.Reset()
+	if _, _, err = client.Step(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = client.Step(challenge[:16]); err != ErrInvalidChallenge {
+		t.Errorf("Unexpected error for short challenge: want=%v, got=%v", ErrInvalidChallenge, err)
+	}
+}
@@ -0,0 +1,350 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"errors"
+	"hash"
+	"strings"
+)
+
+const (
+	gs2HeaderCBSupport         = "p="
+	gs2HeaderNoServerCBSupport = "y,"
+	gs2HeaderNoCBSupport       = "n,"
+)
+
+// Channel binding types in order of preference.
+const (
+	cbTLSExporter       = "tls-exporter"
+	cbTLSServerEndPoint = "tls-server-end-point"
+	cbTLSUnique         = "tls-unique"
+)
+
+var cbPreference = []string{cbTLSExporter, cbTLSServerEndPoint, cbTLSUnique}
+
+// versionTLS13 is tls.VersionTLS13, which is not defined by older versions of
+// Go.
+const versionTLS13 = 0x0304
+
+// gs2Header is the parsed form of the GS2 header that starts the first message
+// sent by clients of SCRAM and GS2 family mechanisms (RFC 5801 §4).
+type gs2Header struct {
+	// flag is the channel binding flag: 'n', 'y', or 'p'.
+	flag byte
+	// cbType is the channel binding type if flag is 'p'.
+	cbType string
+	// identity is the unescaped authorization identity, if any.
+	identity []byte
+	// raw is the entire header including the trailing comma.
+	raw []byte
+}
+
+// getGS2Header returns the GS2 header that a client should send and, if the
+// client is requesting channel binding, the channel binding type to use.
+func getGS2Header(name string, n *Negotiator) (gs2Header []byte, cbType string, err error) {
+	_, _, identity := n.Credentials()
+	switch {
+	case n.TLSState() == nil:
+		// We do not support channel binding
+		gs2Header = []byte(gs2HeaderNoCBSupport)
+	case !strings.HasSuffix(name, "-PLUS"):
+		if n.remoteMechanisms != nil && !contains(n.remoteMechanisms, name+"-PLUS") {
+			// We support channel binding, but the server did not advertise it so
+			// we had to fall back to the non-PLUS variant.
+			// Servers that do support it will know the list was tampered with.
+			gs2Header = []byte(gs2HeaderNoServerCBSupport)
+		} else {
+			// The server supports channel binding (or we don't know what it
+			// supports) but the non-PLUS variant was selected anyways.
+			gs2Header = []byte(gs2HeaderNoCBSupport)
+		}
+	case n.State()&RemoteCB == RemoteCB:
+		// We support channel binding and the server does too
+		if cbType, err = clientChannelBindingType(n); err != nil {
+			return nil, "", err
+		}
+		gs2Header = append([]byte(gs2HeaderCBSupport), cbType...)
+		gs2Header = append(gs2Header, ',')
+	case n.State()&RemoteCB != RemoteCB:
+		// We support channel binding but the server does not
+		gs2Header = []byte(gs2HeaderNoServerCBSupport)
+	}
+	return appendGS2Identity(gs2Header, identity), cbType, nil
+}
+
+// appendGS2Identity appends the authorization identity, if any, and the
+// trailing comma to a GS2 header that starts with the channel binding flag.
+func appendGS2Identity(gs2Header, identity []byte) []byte {
+	if len(identity) > 0 {
+		gs2Header = append(gs2Header, []byte(`a=`)...)
+		gs2Header = append(gs2Header, escapeSASLName(identity)...)
+	}
+	return append(gs2Header, ',')
+}
+
+// clientChannelBindingType picks the most preferred channel binding type that
+// the server supports and that can be computed from the clients TLS state.
+// If the types supported by the server are not known, tls-exporter and
+// tls-unique are assumed.
+func clientChannelBindingType(n *Negotiator) (string, error) {
+	types := n.cbTypes
+	if types == nil {
+		// tls-unique is the default (RFC 5929), except on TLS 1.3 where it is not
+		// defined and is replaced by tls-exporter (RFC 9266).
+		types = []string{cbTLSExporter, cbTLSUnique}
+	}
+	for _, cbType := range cbPreference {
+		if contains(types, cbType) && canBind(n, cbType, false) {
+			return cbType, nil
+		}
+	}
+	return "", ErrChannelBinding
+}
+
+// serverAcceptsChannelBinding reports whether a server can verify channel
+// binding data of the given type.
+// If the ChannelBindingTypes option was not used, any type that the server can
+// compute is accepted.
+func serverAcceptsChannelBinding(n *Negotiator, cbType string) bool {
+	if n.cbTypes != nil && !contains(n.cbTypes, cbType) {
+		return false
+	}
+	return canBind(n, cbType, true)
+}
+
+// serverChannelBindingTypes returns the channel binding types that a server
+// advertises: those set with the ChannelBindingTypes option that it can verify
+// on the current connection.
+func serverChannelBindingTypes(n *Negotiator) []string {
+	var types []string
+	for _, cbType := range n.cbTypes {
+		if canBind(n, cbType, true) {
+			types = append(types, cbType)
+		}
+	}
+	return types
+}
+
+// canBind reports whether the channel binding data of the given type can be
+// computed from the TLS state.
+func canBind(n *Negotiator, cbType string, server bool) bool {
+	tlsState := n.TLSState()
+	if tlsState == nil {
+		return false
+	}
+	switch cbType {
+	case cbTLSExporter:
+		// RFC 9266 only defines tls-exporter for TLS 1.2 when the extended master
+		// secret extension is used, which we can't tell from the connection
+		// state, so only use it with TLS 1.3.
+		return tlsState.HandshakeComplete && tlsState.Version == versionTLS13
+	case cbTLSServerEndPoint:
+		cert := endPointCert(n, server)
+		if cert == nil {
+			return false
+		}
+		_, ok := endPointHash(cert)
+		return ok
+	case cbTLSUnique:
+		// tls-unique is not defined for TLS 1.3 and the connection state leaves it
+		// empty.
+		return tlsState.Version != versionTLS13
+	}
+	return false
+}
+
+// channelBindingData returns the channel binding data of the given type.
+func channelBindingData(n *Negotiator, cbType string) ([]byte, error) {
+	tlsState := n.TLSState()
+	if tlsState == nil {
+		return nil, ErrChannelBinding
+	}
+	switch cbType {
+	case cbTLSExporter:
+		return tlsState.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+	case cbTLSServerEndPoint:
+		cert := endPointCert(n, n.State()&Receiving == Receiving)
+		if cert == nil {
+			return nil, ErrChannelBinding
+		}
+		h, ok := endPointHash(cert)
+		if !ok {
+			return nil, ErrChannelBinding
+		}
+		h.Write(cert.Raw)
+		return h.Sum(nil), nil
+	case cbTLSUnique:
+		return tlsState.TLSUnique, nil
+	}
+	return nil, ErrChannelBinding
+}
+
+// endPointCert returns the certificate of the server, which is used to compute
+// tls-server-end-point channel binding data, or nil if it is not known.
+// The connection state of a server does not include its own certificate so it
+// must be provided with the ServerCertificate option.
+func endPointCert(n *Negotiator, server bool) *x509.Certificate {
+	if server {
+		return n.serverCert
+	}
+	tlsState := n.TLSState()
+	if tlsState == nil || len(tlsState.PeerCertificates) == 0 {
+		return nil
+	}
+	return tlsState.PeerCertificates[0]
+}
+
+// endPointHash returns the hash function used to compute tls-server-end-point
+// channel binding data for the certificate as defined in RFC 5929 §4.1.
+func endPointHash(cert *x509.Certificate) (hash.Hash, bool) {
+	switch cert.SignatureAlgorithm {
+	case x509.MD2WithRSA, x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1,
+		x509.SHA256WithRSA, x509.DSAWithSHA256, x509.ECDSAWithSHA256, x509.SHA256WithRSAPSS:
+		// MD5 and SHA-1 are replaced with SHA-256.
+		return sha256.New(), true
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		return sha512.New384(), true
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		return sha512.New(), true
+	}
+	return nil, false
+}
+
+// parseGS2Header splits the GS2 header from the start of a clients first
+// message and returns it along with the remainder of the message.
+func parseGS2Header(b []byte) (h gs2Header, rest []byte, err error) {
+	idx := bytes.IndexByte(b, ',')
+	if idx < 1 {
+		return h, nil, ErrInvalidChallenge
+	}
+	cbind := b[:idx]
+	switch {
+	case len(cbind) == 1 && (cbind[0] == 'n' || cbind[0] == 'y'):
+		h.flag = cbind[0]
+	case len(cbind) > 2 && cbind[0] == 'p' && cbind[1] == '=':
+		h.flag = 'p'
+		h.cbType = string(cbind[2:])
+	default:
+		return h, nil, ErrInvalidChallenge
+	}
+
+	authzid := b[idx+1:]
+	end := bytes.IndexByte(authzid, ',')
+	if end < 0 {
+		return h, nil, ErrInvalidChallenge
+	}
+	authzid = authzid[:end]
+	if len(authzid) > 0 {
+		if len(authzid) < 2 || authzid[0] != 'a' || authzid[1] != '=' {
+			return h, nil, ErrInvalidChallenge
+		}
+		if h.identity, err = unescapeSASLName(authzid[2:]); err != nil {
+			return h, nil, err
+		}
+	}
+
+	headerLen := idx + 1 + end + 1
+	h.raw = b[:headerLen]
+	return h, b[headerLen:], nil
+}
+
+// checkGS2Header verifies that the channel binding flag sent by a client is
+// consistent with the mechanism it selected and with what the server
+// advertised.
+//
+// A client that supports channel binding but did not see a -PLUS variant of
+// the mechanism in the list of mechanisms sends the "y" flag.
+// If the server did advertise one and could have used it on this connection,
+// the list must have been modified by an attacker to downgrade the negotiation
+// and ErrDowngrade is returned.
+// On servers the list of advertised mechanisms is set using the
+// AdvertisedMechanisms option.
+func checkGS2Header(name string, n *Negotiator, h gs2Header) error {
+	plus := strings.HasSuffix(name, "-PLUS")
+	switch h.flag {
+	case 'p':
+		if !plus {
+			return errors.New("Channel binding requested without a -PLUS mechanism")
+		}
+		if n.TLSState() == nil {
+			return errors.New("Channel binding requested without TLS")
+		}
+	case 'y':
+		if plus {
+			return errors.New("Channel binding not requested for a -PLUS mechanism")
+		}
+		if n.TLSState() != nil && contains(n.advertised, name+"-PLUS") {
+			return ErrDowngrade
+		}
+	default:
+		if plus {
+			return errors.New("Channel binding not requested for a -PLUS mechanism")
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// escapeSASLName replaces "=" and "," with "=3D" and "=2C" respectively as
+// required for the saslname production of RFC 5802 and RFC 5801.
+func escapeSASLName(name []byte) []byte {
+	n := bytes.Count(name, []byte{'='}) + bytes.Count(name, []byte{','})
+	if n == 0 {
+		return name
+	}
+	escaped := make([]byte, 0, len(name)+(n*2))
+	for _, c := range name {
+		switch c {
+		case '=':
+			escaped = append(escaped, "=3D"...)
+		case ',':
+			escaped = append(escaped, "=2C"...)
+		default:
+			escaped = append(escaped, c)
+		}
+	}
+	return escaped
+}
+
+// unescapeSASLName reverses escapeSASLName.
+// Any "=" that does not start a valid escape sequence is an error.
+func unescapeSASLName(name []byte) ([]byte, error) {
+	if bytes.IndexByte(name, '=') < 0 {
+		return name, nil
+	}
+	unescaped := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			unescaped = append(unescaped, name[i])
+			continue
+		}
+		if i+2 >= len(name) {
+			return nil, ErrInvalidChallenge
+		}
+		switch string(name[i+1 : i+3]) {
+		case "3D":
+			unescaped = append(unescaped, '=')
+		case "2C":
+			unescaped = append(unescaped, ',')
+		default:
+			return nil, ErrInvalidChallenge
+		}
+		i += 2
+	}
+	return unescaped, nil
+}
@@ -0,0 +1,222 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// tlsPair performs a TLS handshake over an in-memory connection and returns
+// the connection state of the client and server.
+func tlsPair(t *testing.T, version uint16) (client, server tls.ConnectionState) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"example.net"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert := tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+
+	c, s := net.Pipe()
+	defer c.Close()
+	defer s.Close()
+	clientConn := tls.Client(c, &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion:         version,
+		MaxVersion:         version,
+	})
+	serverConn := tls.Server(s, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   version,
+		MaxVersion:   version,
+	})
+	errs := make(chan error, 1)
+	go func() {
+		errs <- serverConn.Handshake()
+	}()
+	if err = clientConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-errs; err != nil {
+		t.Fatal(err)
+	}
+	return clientConn.ConnectionState(), serverConn.ConnectionState()
+}
+
+func TestChannelBindingTypes(t *testing.T) {
+	tls12Client, tls12Server := tlsPair(t, tls.VersionTLS12)
+	tls13Client, tls13Server := tlsPair(t, versionTLS13)
+
+	for _, tc := range [...]struct {
+		name        string
+		clientState tls.ConnectionState
+		serverState tls.ConnectionState
+		clientTypes []string
+		serverTypes []string
+		header      string
+		clientErr   error
+		serverErr   error
+	}{
+		{
+			name:        "TLS13/Default",
+			clientState: tls13Client, serverState: tls13Server,
+			clientTypes: []string{"tls-unique", "tls-server-end-point", "tls-exporter"},
+			header:      "p=tls-exporter,,",
+		},
+		{
+			name:        "TLS13/EndPointNotOnServer",
+			clientState: tls13Client, serverState: tls13Server,
+			clientTypes: []string{"tls-unique", "tls-server-end-point"},
+			header:      "p=tls-server-end-point,,",
+			serverErr:   ErrChannelBinding,
+		},
+		{
+			name:        "TLS13/NoUnique",
+			clientState: tls13Client, serverState: tls13Server,
+			clientTypes: []string{"tls-unique"},
+			clientErr:   ErrChannelBinding,
+		},
+		{
+			name:        "TLS13/ServerTypes",
+			clientState: tls13Client, serverState: tls13Server,
+			serverTypes: []string{"tls-unique"},
+			clientTypes: []string{"tls-exporter"},
+			header:      "p=tls-exporter,,",
+			serverErr:   ErrChannelBinding,
+		},
+		{
+			name:        "TLS12/Unique",
+			clientState: tls12Client, serverState: tls12Server,
+			clientTypes: []string{"tls-unique", "tls-exporter"},
+			header:      "p=tls-unique,,",
+		},
+		{
+			name:        "TLS13/Unknown",
+			clientState: tls13Client, serverState: tls13Server,
+			header: "p=tls-exporter,,",
+		},
+		{
+			name:        "TLS12/Unknown",
+			clientState: tls12Client, serverState: tls12Server,
+			header: "p=tls-unique,,",
+		},
+		{
+			name:        "TLS12/NoneSupported",
+			clientState: tls12Client, serverState: tls12Server,
+			clientTypes: []string{"tls-exporter", "x-made-up"},
+			clientErr:   ErrChannelBinding,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var clientOpts, serverOpts []Option
+			if tc.clientTypes != nil {
+				clientOpts = append(clientOpts, ChannelBindingTypes(tc.clientTypes...))
+			}
+			if tc.serverTypes != nil {
+				serverOpts = append(serverOpts, ChannelBindingTypes(tc.serverTypes...))
+			}
+			client := NewClient(ScramSha256Plus, append(clientOpts,
+				TLSState(tc.clientState),
+				RemoteMechanisms("SCRAM-SHA-256-PLUS"),
+				Credentials(func() ([]byte, []byte, []byte) {
+					return []byte("user"), []byte("pencil"), nil
+				}),
+			)...)
+			server := NewServer(ScramSha256Plus, acceptAll, append(serverOpts,
+				TLSState(tc.serverState),
+				AdvertisedMechanisms("SCRAM-SHA-256-PLUS"),
+				ScramCredentials(scramCredentials),
+			)...)
+
+			if tc.header != "" {
+				_, resp, err := client.Step(nil)
+				if err != nil {
+					t.Fatalf("Unexpected client error: %v", err)
+				}
+				if !bytes.HasPrefix(resp, []byte(tc.header)) {
+					t.Errorf("Unexpected GS2 header: want=%q, got=%q", tc.header, resp)
+				}
+				client.Reset()
+			}
+
+			clientErr, serverErr := stepPair(client, server)
+			if clientErr != tc.clientErr {
+				t.Errorf("Unexpected client error: want=%v, got=%v", tc.clientErr, clientErr)
+			}
+			if serverErr != tc.serverErr {
+				t.Errorf("Unexpected server error: want=%v, got=%v", tc.serverErr, serverErr)
+			}
+		})
+	}
+}
+
+func TestTLSServerEndPoint(t *testing.T) {
+	state, _ := tlsPair(t, tls.VersionTLS12)
+	n := NewClient(ScramSha256Plus, TLSState(state))
+	data, err := channelBindingData(n, "tls-server-end-point")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The certificate is signed using ECDSA with SHA-256.
+	want := sha256.Sum256(state.PeerCertificates[0].Raw)
+	if !bytes.Equal(data, want[:]) {
+		t.Errorf("Unexpected channel binding data: want=%x, got=%x", want, data)
+	}
+}
+
+func TestParseGS2Header(t *testing.T) {
+	for i, tc := range [...]struct {
+		in       string
+		flag     byte
+		cbType   string
+		identity string
+		rest     string
+		err      bool
+	}{
+		0: {in: "n,,n=user", flag: 'n', rest: "n=user"},
+		1: {in: "y,,n=user", flag: 'y', rest: "n=user"},
+		2: {in: "p=tls-unique,a=ad=2Cmin=3D,n=user", flag: 'p', cbType: "tls-unique", identity: "ad,min=", rest: "n=user"},
+		3: {in: "x,,n=user", err: true},
+		4: {in: "p=,,n=user", err: true},
+		5: {in: "n,b=admin,n=user", err: true},
+		6: {in: "n,a=ad=min,n=user", err: true},
+		7: {in: "n,", err: true},
+		8: {in: "", err: true},
+	} {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			h, rest, err := parseGS2Header([]byte(tc.in))
+			switch {
+			case tc.err && err == nil:
+				t.Fatal("Expected error")
+			case !tc.err && err != nil:
+				t.Fatalf("Unexpected error: %v", err)
+			case tc.err:
+				return
+			}
+			if h.flag != tc.flag || h.cbType != tc.cbType || string(h.identity) != tc.identity || string(rest) != tc.rest {
+				t.Errorf("Unexpected parse: flag=%q cbType=%q identity=%q rest=%q", h.flag, h.cbType, h.identity, rest)
+			}
+		})
+	}
+}
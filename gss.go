@@ -0,0 +1,306 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/base32"
+	"errors"
+)
+
+// krb5OID is the object identifier of the Kerberos V5 GSS-API mechanism.
+var krb5OID = asn1.ObjectIdentifier{1, 2, 840, 113554, 1, 2, 2}
+
+// The flag sent by GS2 clients before the GS2 header if the initial context
+// token does not start with the header defined in RFC 2743 §3.1.
+const gs2NonStdFlag = "F,"
+
+// A GSSContext is a GSS-API security context used by GS2 mechanisms.
+type GSSContext interface {
+	// Step calls GSS_Init_sec_context on clients or GSS_Accept_sec_context on
+	// servers with a token received from the other side (nil for the first call
+	// on a client).
+	// It returns the token to send, if any, and whether the context has been
+	// fully established.
+	// Mutual authentication must be requested by clients.
+	Step(token []byte) (out []byte, established bool, err error)
+
+	// Peer returns the name of the authenticated client once the context has
+	// been established on a server.
+	Peer() ([]byte, error)
+
+	// Close releases the context.
+	Close() error
+}
+
+// GSS provides GS2 mechanisms with an implementation of the underlying GSS-API
+// mechanism.
+// At the start of each negotiation f is called to create a new initiator
+// context on clients, or acceptor context on servers, for the mechanism with
+// the given object identifier.
+// The context must use bindings as the application data of its channel
+// bindings.
+// If this option is not used GS2KRB5 and GS2KRB5Plus use the systems GSS-API
+// library (or SSPI on Windows).
+func GSS(f func(n *Negotiator, mech asn1.ObjectIdentifier, bindings []byte) (GSSContext, error)) Option {
+	return func(n *Negotiator) {
+		n.gss = f
+	}
+}
+
+// gs2State is cached between steps by GS2 mechanisms.
+type gs2State struct {
+	ctx         GSSContext
+	established bool
+	identity    []byte
+}
+
+// GS2 returns a Mechanism that implements the GS2 family of mechanisms defined
+// in RFC 5801 for the GSS-API mechanism with the given object identifier.
+// If plus is true the -PLUS variant, which uses channel binding, is returned.
+// The name of the mechanism is derived from the object identifier except for
+// Kerberos V5, which uses the registered name GS2-KRB5.
+// The GSS-API mechanism is provided with the GSS option.
+// If the object identifier cannot be encoded an error is returned.
+func GS2(oid asn1.ObjectIdentifier, plus bool) (Mechanism, error) {
+	oidDER, err := asn1.Marshal(oid)
+	if err != nil {
+		return Mechanism{}, err
+	}
+	return gs2(oid, oidDER, plus, nil), nil
+}
+
+func gs2KRB5(spn string) Mechanism {
+	// The Kerberos OID can always be encoded.
+	oidDER, _ := asn1.Marshal(krb5OID)
+	return gs2(krb5OID, oidDER, false, newKRB5Context(spn))
+}
+
+func gs2KRB5Plus(spn string) Mechanism {
+	oidDER, _ := asn1.Marshal(krb5OID)
+	return gs2(krb5OID, oidDER, true, newKRB5Context(spn))
+}
+
+// gs2 returns a GS2 mechanism that creates its GSS-API contexts with the GSS
+// option or, if it was not used, with newContext.
+func gs2(oid asn1.ObjectIdentifier, oidDER []byte, plus bool, newContext func(*Negotiator, asn1.ObjectIdentifier, []byte) (GSSContext, error)) Mechanism {
+	name := gs2Name(oidDER)
+	if oid.Equal(krb5OID) {
+		name = "GS2-KRB5"
+	}
+	props := NoPlaintext | MutualAuth
+	if plus {
+		name += "-PLUS"
+		props |= ChannelBinding
+	}
+	factory := func(m *Negotiator) func(*Negotiator, asn1.ObjectIdentifier, []byte) (GSSContext, error) {
+		if m.gss != nil {
+			return m.gss
+		}
+		return newContext
+	}
+
+	return Mechanism{
+		Name:       name,
+		Properties: props,
+		Close: func(_ *Negotiator, data interface{}) error {
+			state, ok := data.(*gs2State)
+			if !ok || state == nil || state.ctx == nil {
+				return nil
+			}
+			return state.ctx.Close()
+		},
+		Start: func(m *Negotiator) (more bool, resp []byte, cache interface{}, err error) {
+			header, cbType, err := getGS2Header(name, m)
+			if err != nil {
+				return false, nil, nil, err
+			}
+			bindings := header
+			if cbType != "" {
+				cbData, err := channelBindingData(m, cbType)
+				if err != nil {
+					return false, nil, nil, err
+				}
+				bindings = append(append([]byte{}, header...), cbData...)
+			}
+
+			newContext := factory(m)
+			if newContext == nil {
+				return false, nil, nil, errors.New("A GSS-API implementation is required")
+			}
+			ctx, err := newContext(m, oid, bindings)
+			if err != nil {
+				return false, nil, nil, err
+			}
+			state := &gs2State{ctx: ctx}
+			token, established, err := ctx.Step(nil)
+			if err != nil {
+				return false, nil, state, err
+			}
+			state.established = established
+
+			if inner, ok := gssStripHeader(token, oidDER); ok {
+				resp = append(header, inner...)
+			} else {
+				resp = append([]byte(gs2NonStdFlag), header...)
+				resp = append(resp, token...)
+			}
+			return true, resp, state, nil
+		},
+		Next: func(m *Negotiator, challenge []byte, data interface{}) (more bool, resp []byte, cache interface{}, err error) {
+			if m.State()&Receiving == Receiving {
+				return gs2ServerNext(name, oid, oidDER, factory(m), m, challenge, data)
+			}
+
+			state, ok := data.(*gs2State)
+			if !ok {
+				return false, nil, nil, ErrInvalidState
+			}
+			if state.established {
+				// The context was established by our last token and the server has
+				// nothing more to send.
+				if len(challenge) > 0 {
+					return false, nil, state, ErrInvalidChallenge
+				}
+				return false, nil, state, nil
+			}
+			token, established, err := state.ctx.Step(challenge)
+			if err != nil {
+				return false, nil, state, err
+			}
+			state.established = established
+			// If the final token from the server established the context it was
+			// sent as additional data with the success message.
+			if established && len(token) == 0 {
+				return false, nil, state, nil
+			}
+			return true, token, state, nil
+		},
+	}
+}
+
+func gs2ServerNext(name string, oid asn1.ObjectIdentifier, oidDER []byte, newContext func(*Negotiator, asn1.ObjectIdentifier, []byte) (GSSContext, error), m *Negotiator, challenge []byte, data interface{}) (more bool, resp []byte, cache interface{}, err error) {
+	state, _ := data.(*gs2State)
+	if m.State()&StepMask == AuthTextSent {
+		nonStd := bytes.HasPrefix(challenge, []byte(gs2NonStdFlag))
+		if nonStd {
+			challenge = challenge[len(gs2NonStdFlag):]
+		}
+		header, token, err := parseGS2Header(challenge)
+		if err != nil {
+			return false, nil, nil, err
+		}
+		if err = checkGS2Header(name, m, header); err != nil {
+			return false, nil, nil, err
+		}
+
+		// The channel bindings are the GS2 header (without the non-standard
+		// token flag) followed by the channel binding data, if any.
+		bindings := header.raw
+		if header.flag == 'p' {
+			if !serverAcceptsChannelBinding(m, header.cbType) {
+				return false, nil, nil, ErrChannelBinding
+			}
+			cbData, err := channelBindingData(m, header.cbType)
+			if err != nil {
+				return false, nil, nil, err
+			}
+			bindings = append(append([]byte{}, bindings...), cbData...)
+		}
+		if !nonStd {
+			token = gssAddHeader(token, oidDER)
+		}
+
+		if newContext == nil {
+			return false, nil, nil, ErrAuthn
+		}
+		ctx, err := newContext(m, oid, bindings)
+		if err != nil {
+			return false, nil, nil, err
+		}
+		state = &gs2State{ctx: ctx, identity: header.identity}
+		challenge = token
+	}
+	if state == nil {
+		return false, nil, nil, ErrInvalidState
+	}
+
+	token, established, err := state.ctx.Step(challenge)
+	if err != nil {
+		return false, nil, state, err
+	}
+	if !established {
+		return true, token, state, nil
+	}
+	state.established = true
+
+	username, err := state.ctx.Peer()
+	if err != nil {
+		return false, nil, state, err
+	}
+	identity := state.identity
+	if !m.Permissions(Credentials(func() (Username, Password, Identity []byte) {
+		return username, nil, identity
+	})) {
+		return false, nil, state, ErrAuthn
+	}
+	// Any final token is sent as additional data with the success message.
+	return false, token, state, nil
+}
+
+// gs2Name returns the name of the GS2 mechanism for a GSS-API mechanism with
+// the given DER encoded object identifier as defined in RFC 5801 §3.1: "GS2-"
+// followed by the base32 encoding of the first 55 bits of its SHA-1 hash.
+func gs2Name(oidDER []byte) string {
+	sum := sha1.Sum(oidDER)
+	b := sum[:7]
+	b[6] &^= 1
+	return "GS2-" + base32.StdEncoding.EncodeToString(b)[:11]
+}
+
+// gssStripHeader removes the mechanism independent token header defined in RFC
+// 2743 §3.1 from an initial context token.
+// If the token does not start with a header for the mechanism, ok is false.
+func gssStripHeader(token, oidDER []byte) (inner []byte, ok bool) {
+	if len(token) < 2 || token[0] != 0x60 {
+		return nil, false
+	}
+	l, n := int(token[1]), 2
+	if l&0x80 != 0 {
+		octets := l & 0x7f
+		if octets == 0 || octets > 4 || len(token) < 2+octets {
+			return nil, false
+		}
+		l = 0
+		for _, b := range token[2 : 2+octets] {
+			l = l<<8 | int(b)
+		}
+		n += octets
+	}
+	if l != len(token)-n || !bytes.HasPrefix(token[n:], oidDER) {
+		return nil, false
+	}
+	return token[n+len(oidDER):], true
+}
+
+// gssAddHeader reverses gssStripHeader.
+func gssAddHeader(inner, oidDER []byte) []byte {
+	l := len(oidDER) + len(inner)
+	token := []byte{0x60}
+	if l < 0x80 {
+		token = append(token, byte(l))
+	} else {
+		var lenBytes []byte
+		for v := l; v > 0; v >>= 8 {
+			lenBytes = append([]byte{byte(v)}, lenBytes...)
+		}
+		token = append(token, 0x80|byte(len(lenBytes)))
+		token = append(token, lenBytes...)
+	}
+	token = append(token, oidDER...)
+	return append(token, inner...)
+}
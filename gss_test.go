@@ -0,0 +1,239 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/asn1"
+	"errors"
+	"testing"
+)
+
+// toyOID is the object identifier of a stand-in GSS-API mechanism under the
+// private enterprise number reserved for documentation.
+var toyOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 32473, 1}
+
+var errBadBindings = errors.New("channel bindings do not match")
+
+// toyContext is a stand-in GSS-API mechanism.
+// The client sends its name and channel bindings, the server checks that the
+// bindings match its own and replies with a token that completes mutual
+// authentication.
+type toyContext struct {
+	server   bool
+	nonStd   bool
+	user     []byte
+	bindings []byte
+	peer     []byte
+	closed   *int
+}
+
+func (c *toyContext) Step(token []byte) ([]byte, bool, error) {
+	oidDER, _ := asn1.Marshal(toyOID)
+	if !c.server {
+		if token == nil {
+			inner := append(append(append([]byte{}, c.user...), 0), c.bindings...)
+			if c.nonStd {
+				return inner, false, nil
+			}
+			return gssAddHeader(inner, oidDER), false, nil
+		}
+		if string(token) != "accept" {
+			return nil, false, ErrAuthn
+		}
+		return nil, true, nil
+	}
+
+	if !c.nonStd {
+		var ok bool
+		if token, ok = gssStripHeader(token, oidDER); !ok {
+			return nil, false, ErrInvalidChallenge
+		}
+	}
+	idx := bytes.IndexByte(token, 0)
+	if idx < 0 {
+		return nil, false, ErrInvalidChallenge
+	}
+	if !bytes.Equal(token[idx+1:], c.bindings) {
+		return nil, false, errBadBindings
+	}
+	c.peer = token[:idx]
+	return []byte("accept"), true, nil
+}
+
+func (c *toyContext) Peer() ([]byte, error) {
+	return c.peer, nil
+}
+
+func (c *toyContext) Close() error {
+	*c.closed++
+	return nil
+}
+
+func TestGS2(t *testing.T) {
+	otherTLS := tls.ConnectionState{TLSUnique: []byte{9, 8, 7, 6, 5, 4, 3, 2, 1, 0}}
+	toyPlus, err := GS2(toyOID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toy, err := GS2(toyOID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range [...]struct {
+		name       string
+		mechanism  Mechanism
+		identity   string
+		nonStd     bool
+		clientOpts []Option
+		serverOpts []Option
+		bindings   string
+		clientErr  bool
+		serverErr  bool
+		wantErr    error
+	}{
+		{name: "Valid", mechanism: toy, bindings: "n,,"},
+		{name: "Identity", mechanism: toy, identity: "admin=,", bindings: "n,a=admin=3D=2C,"},
+		{name: "NonStandardToken", mechanism: toy, nonStd: true, bindings: "n,,"},
+		{
+			name:       "Plus",
+			mechanism:  toyPlus,
+			clientOpts: []Option{TLSState(scramTLS), RemoteMechanisms(toyPlus.Name)},
+			serverOpts: []Option{TLSState(scramTLS)},
+			bindings:   "p=tls-unique,,\x00\x01\x02\x03\x04\x05\x06\x07\x08\x09",
+		},
+		{
+			name:       "PlusWrongChannel",
+			mechanism:  toyPlus,
+			clientOpts: []Option{TLSState(scramTLS), RemoteMechanisms(toyPlus.Name)},
+			serverOpts: []Option{TLSState(otherTLS)},
+			serverErr:  true,
+			wantErr:    errBadBindings,
+		},
+		{
+			name:       "PlusNoServerSupport",
+			mechanism:  toyPlus,
+			clientOpts: []Option{TLSState(scramTLS)},
+			serverOpts: []Option{TLSState(scramTLS)},
+			serverErr:  true,
+		},
+		{
+			name:       "ClientNoCB",
+			mechanism:  toy,
+			clientOpts: []Option{TLSState(scramTLS), RemoteMechanisms(toy.Name)},
+			serverOpts: []Option{TLSState(scramTLS), AdvertisedMechanisms(toy.Name)},
+			bindings:   "y,,",
+		},
+		{
+			name:       "Downgrade",
+			mechanism:  toy,
+			clientOpts: []Option{TLSState(scramTLS), RemoteMechanisms(toy.Name)},
+			serverOpts: []Option{TLSState(scramTLS), AdvertisedMechanisms(toyPlus.Name, toy.Name)},
+			serverErr:  true,
+			wantErr:    ErrDowngrade,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var closed int
+			var clientBindings, serverBindings []byte
+			identity := tc.identity
+			nonStd := tc.nonStd
+			clientOpts := append([]Option{
+				Credentials(func() ([]byte, []byte, []byte) {
+					return nil, nil, []byte(identity)
+				}),
+				GSS(func(_ *Negotiator, mech asn1.ObjectIdentifier, bindings []byte) (GSSContext, error) {
+					if !mech.Equal(toyOID) {
+						t.Errorf("Unexpected mechanism: %v", mech)
+					}
+					clientBindings = bindings
+					return &toyContext{user: []byte("juliet"), bindings: bindings, nonStd: nonStd, closed: &closed}, nil
+				}),
+			}, tc.clientOpts...)
+			serverOpts := append([]Option{
+				GSS(func(_ *Negotiator, mech asn1.ObjectIdentifier, bindings []byte) (GSSContext, error) {
+					serverBindings = bindings
+					return &toyContext{server: true, bindings: bindings, nonStd: nonStd, closed: &closed}, nil
+				}),
+			}, tc.serverOpts...)
+			var gotUser, gotIdentity string
+			perm := func(n *Negotiator) bool {
+				u, _, i := n.Credentials()
+				gotUser, gotIdentity = string(u), string(i)
+				return true
+			}
+
+			client := NewClient(tc.mechanism, clientOpts...)
+			server := NewServer(tc.mechanism, perm, serverOpts...)
+			clientErr, serverErr := stepPair(client, server)
+			if (clientErr != nil) != tc.clientErr {
+				t.Errorf("Unexpected client error: %v", clientErr)
+			}
+			if (serverErr != nil) != tc.serverErr || (tc.wantErr != nil && serverErr != tc.wantErr) {
+				t.Errorf("Unexpected server error: want=%v, got=%v", tc.wantErr, serverErr)
+			}
+			if tc.clientErr || tc.serverErr {
+				return
+			}
+			if string(clientBindings) != tc.bindings || string(serverBindings) != tc.bindings {
+				t.Errorf("Unexpected channel bindings: want=%q, client=%q, server=%q", tc.bindings, clientBindings, serverBindings)
+			}
+			if gotUser != "juliet" || gotIdentity != tc.identity {
+				t.Errorf("Unexpected credentials: want=%q/%q, got=%q/%q", "juliet", tc.identity, gotUser, gotIdentity)
+			}
+			if closed != 2 {
+				t.Errorf("Expected both contexts to be closed, got %d", closed)
+			}
+		})
+	}
+}
+
+func TestGS2Name(t *testing.T) {
+	// The example from RFC 5801 §3.1.
+	oidDER, err := asn1.Marshal(krb5OID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := gs2Name(oidDER); name != "GS2-QLJHGJLWNPL" {
+		t.Errorf("Unexpected name derived from the Kerberos OID: %s", name)
+	}
+	krb5, krb5Plus := GS2KRB5(""), GS2KRB5Plus("")
+	if krb5.Name != "GS2-KRB5" || krb5Plus.Name != "GS2-KRB5-PLUS" {
+		t.Errorf("Unexpected Kerberos mechanism names: %s, %s", krb5.Name, krb5Plus.Name)
+	}
+	if krb5Plus.Properties&ChannelBinding == 0 || krb5.Properties&ChannelBinding != 0 {
+		t.Errorf("Only the -PLUS variant should use channel binding")
+	}
+}
+
+func TestGS2InvalidOID(t *testing.T) {
+	// An OID must have at least two components to be encoded.
+	if _, err := GS2(asn1.ObjectIdentifier{1}, false); err == nil {
+		t.Error("Expected an error for an OID that cannot be encoded")
+	}
+}
+
+func TestGSSTokenHeader(t *testing.T) {
+	oidDER, err := asn1.Marshal(krb5OID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, inner := range [][]byte{nil, []byte("token"), bytes.Repeat([]byte{1}, 300)} {
+		token := gssAddHeader(inner, oidDER)
+		got, ok := gssStripHeader(token, oidDER)
+		if !ok || !bytes.Equal(got, inner) {
+			t.Errorf("Failed to round trip a token of length %d", len(inner))
+		}
+	}
+	token := gssAddHeader([]byte("token"), oidDER)
+	if _, ok := gssStripHeader(token[:len(token)-1], oidDER); ok {
+		t.Errorf("Expected a truncated token to be rejected")
+	}
+	toyDER, _ := asn1.Marshal(toyOID)
+	if _, ok := gssStripHeader(token, toyDER); ok {
+		t.Errorf("Expected a token for another mechanism to be rejected")
+	}
+}
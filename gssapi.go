@@ -3,15 +3,17 @@
 package sasl
 
 import (
+	"encoding/asn1"
 	"errors"
 	"sync"
 	"time"
+	"unsafe"
 
 	gss "github.com/apcera/gssapi"
 	"github.com/sirupsen/logrus"
 )
 
-type context struct {
+type secContext struct {
 	lib   *gss.Lib
 	cred  *gss.CredId
 	ctx   *gss.CtxId
@@ -19,27 +21,59 @@ type context struct {
 	flags uint32
 }
 
-var loadOnce sync.Once
+var (
+	loadOnce sync.Once
+	gssLib   *gss.Lib
+	gssErr   error
+)
 
+// loadLib loads the GSS-API library the first time it is called and returns the
+// same result on every call after that.
 func loadLib() (lib *gss.Lib, err error) {
 	loadOnce.Do(func() {
 		logrus.Info("loading gssapi")
 
-		gsslib, er := gss.Load(nil)
-		if er != nil {
-			err = er
-			logrus.WithError(err).Error("failed to load gssapi")
+		gssLib, gssErr = gss.Load(nil)
+		if gssErr != nil {
+			logrus.WithError(gssErr).Error("failed to load gssapi")
 		}
-
-		lib = gsslib
-		return
 	})
-	return
+	return gssLib, gssErr
+}
+
+// releaseContext releases the security context, name, and credential handles
+// held by a secContext.
+func releaseContext(_ *Negotiator, data interface{}) (err error) {
+	ctx, ok := data.(*secContext)
+	if !ok || ctx == nil {
+		return nil
+	}
+	if ctx.ctx != nil {
+		if e := ctx.ctx.Release(); e != nil {
+			err = e
+		}
+		ctx.ctx = nil
+	}
+	if ctx.name != nil {
+		if e := ctx.name.Release(); e != nil && err == nil {
+			err = e
+		}
+		ctx.name = nil
+	}
+	if ctx.cred != nil && ctx.cred != ctx.lib.GSS_C_NO_CREDENTIAL {
+		if e := ctx.cred.Release(); e != nil && err == nil {
+			err = e
+		}
+		ctx.cred = nil
+	}
+	return err
 }
 
 func gssapi(spn string) Mechanism {
 	return Mechanism{
-		Name: "GSSAPI",
+		Name:       "GSSAPI",
+		Properties: NoPlaintext | MutualAuth,
+		Close:      releaseContext,
 		Start: func(m *Negotiator) (bool, []byte, interface{}, error) {
 
 			lib, err := loadLib()
@@ -59,7 +93,7 @@ func gssapi(spn string) Mechanism {
 				return false, nil, nil, errors.New("unable to initialize security context")
 			}
 
-			ctx := &context{
+			ctx := &secContext{
 				cred:  lib.GSS_C_NO_CREDENTIAL,
 				name:  name,
 				ctx:   nil,
@@ -81,6 +115,7 @@ func gssapi(spn string) Mechanism {
 
 			if err != gss.ErrContinueNeeded {
 				logrus.Error(err.Error())
+				releaseContext(m, ctx)
 				return false, nil, nil, errors.New("failed to initialize security context")
 			}
 
@@ -95,14 +130,14 @@ func gssapi(spn string) Mechanism {
 				return false, nil, nil, ErrInvalidChallenge
 			}
 
-			ctx, ok := data.(*context)
+			ctx, ok := data.(*secContext)
 			if !ok {
 				return false, nil, nil, errors.New("invalid context")
 			}
+			// Always hand the context back to the negotiator so that it can be
+			// released with releaseContext when the negotiation ends.
 			defer func() {
-				if err != nil {
-					ctx.ctx.Release()
-				}
+				cache = ctx
 			}()
 
 			state := m.State()
@@ -177,3 +212,166 @@ func gssapi(spn string) Mechanism {
 		},
 	}
 }
+
+// gssBufferDesc and gssChannelBindings have the same layout as the
+// gss_buffer_desc and gss_channel_bindings_struct types of the GSS-API C
+// bindings.
+// The gssapi package has no way to create channel bindings, so they are built
+// in memory allocated by the library.
+type gssBufferDesc struct {
+	length uintptr
+	value  unsafe.Pointer
+}
+
+type gssChannelBindings struct {
+	initiatorAddrType uint32
+	initiatorAddress  gssBufferDesc
+	acceptorAddrType  uint32
+	acceptorAddress   gssBufferDesc
+	applicationData   gssBufferDesc
+}
+
+// krb5Context is a GSSContext for Kerberos V5 backed by the systems GSS-API
+// library.
+type krb5Context struct {
+	lib    *gss.Lib
+	server bool
+	// name is the target on clients and the authenticated peer on servers.
+	name    *gss.Name
+	ctx     *gss.CtxId
+	appData *gss.Buffer
+	cb      *gss.Buffer
+}
+
+func newKRB5Context(spn string) func(*Negotiator, asn1.ObjectIdentifier, []byte) (GSSContext, error) {
+	return func(n *Negotiator, _ asn1.ObjectIdentifier, bindings []byte) (GSSContext, error) {
+		lib, err := loadLib()
+		if err != nil {
+			return nil, err
+		}
+		c := &krb5Context{lib: lib, server: n.State()&Receiving == Receiving}
+
+		// The application data and the channel bindings that point to it are both
+		// allocated in C memory.
+		if c.appData, err = lib.MakeBufferBytes(bindings); err != nil {
+			return nil, err
+		}
+		if c.cb, err = lib.MakeBufferBytes(make([]byte, unsafe.Sizeof(gssChannelBindings{}))); err != nil {
+			c.Close()
+			return nil, err
+		}
+		cb := (*gssChannelBindings)((*gssBufferDesc)(unsafe.Pointer(c.cb.C_gss_buffer_t)).value)
+		cb.applicationData = *(*gssBufferDesc)(unsafe.Pointer(c.appData.C_gss_buffer_t))
+
+		if !c.server {
+			nameBuf, err := lib.MakeBufferString(spn)
+			if err != nil {
+				c.Close()
+				return nil, err
+			}
+			defer nameBuf.Release()
+			if c.name, err = nameBuf.Name(lib.GSS_KRB5_NT_PRINCIPAL_NAME); err != nil {
+				c.Close()
+				return nil, err
+			}
+		}
+		return c, nil
+	}
+}
+
+func (c *krb5Context) channelBindings() gss.ChannelBindings {
+	return gss.ChannelBindings((*gssBufferDesc)(unsafe.Pointer(c.cb.C_gss_buffer_t)).value)
+}
+
+func (c *krb5Context) Step(token []byte) ([]byte, bool, error) {
+	in := c.lib.GSS_C_NO_BUFFER
+	if len(token) > 0 {
+		var err error
+		if in, err = c.lib.MakeBufferBytes(token); err != nil {
+			return nil, false, err
+		}
+		defer in.Release()
+	}
+
+	if c.ctx == nil {
+		c.ctx = c.lib.NewCtxId()
+	}
+	var ctx *gss.CtxId
+	var out *gss.Buffer
+	var err error
+	if c.server {
+		var peer *gss.Name
+		var delegated *gss.CredId
+		ctx, peer, _, out, _, _, delegated, err = c.lib.AcceptSecContext(c.ctx, c.lib.GSS_C_NO_CREDENTIAL, in, c.channelBindings())
+		if delegated != nil {
+			delegated.Release()
+		}
+		if err == nil {
+			c.name = peer
+		} else if peer != nil {
+			peer.Release()
+		}
+	} else {
+		ctx, _, out, _, _, err = c.lib.InitSecContext(
+			c.lib.GSS_C_NO_CREDENTIAL,
+			c.ctx,
+			c.name,
+			c.lib.GSS_MECH_KRB5,
+			gss.GSS_C_MUTUAL_FLAG,
+			time.Duration(0),
+			c.channelBindings(),
+			in)
+	}
+	if ctx != nil {
+		c.ctx = ctx
+	}
+	if out != nil {
+		defer out.Release()
+	}
+	if err != nil && err != gss.ErrContinueNeeded {
+		return nil, false, err
+	}
+
+	var resp []byte
+	if out != nil {
+		resp = append(resp, out.Bytes()...)
+	}
+	return resp, err == nil, nil
+}
+
+func (c *krb5Context) Peer() ([]byte, error) {
+	if !c.server || c.name == nil {
+		return nil, ErrInvalidState
+	}
+	name, _, err := c.name.Display()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(name), nil
+}
+
+func (c *krb5Context) Close() (err error) {
+	if c.ctx != nil {
+		err = c.ctx.Release()
+		c.ctx = nil
+	}
+	if c.name != nil {
+		if e := c.name.Release(); e != nil && err == nil {
+			err = e
+		}
+		c.name = nil
+	}
+	if c.cb != nil {
+		if e := c.cb.Release(); e != nil && err == nil {
+			err = e
+		}
+		c.cb = nil
+	}
+	if c.appData != nil {
+		if e := c.appData.Release(); e != nil && err == nil {
+			err = e
+		}
+		c.appData = nil
+	}
+	return err
+}
@@ -3,6 +3,8 @@
 package sasl
 
 import (
+	"encoding/asn1"
+	"encoding/binary"
 	"errors"
 	"syscall"
 	"unsafe"
@@ -10,7 +12,7 @@ import (
 	"github.com/alexbrainman/sspi"
 )
 
-type context struct {
+type secContext struct {
 	creds            *sspi.Credentials
 	spn              string
 	Handle           sspi.CtxtHandle
@@ -19,7 +21,7 @@ type context struct {
 	expiry           syscall.Filetime
 }
 
-func (c *context) Sizes() (*sspi.SecPkgContext_Sizes, syscall.Errno) {
+func (c *secContext) Sizes() (*sspi.SecPkgContext_Sizes, syscall.Errno) {
 	var s sspi.SecPkgContext_Sizes
 	ret := sspi.QueryContextAttributes(&c.Handle, sspi.SECPKG_ATTR_SIZES, (*byte)(unsafe.Pointer(&s)))
 	if ret != sspi.SEC_E_OK {
@@ -28,12 +30,33 @@ func (c *context) Sizes() (*sspi.SecPkgContext_Sizes, syscall.Errno) {
 	return &s, ret
 }
 
+// releaseContext deletes the security context and frees the credentials handle
+// held by a secContext.
+func releaseContext(_ *Negotiator, data interface{}) error {
+	ctx, ok := data.(secContext)
+	if !ok {
+		return nil
+	}
+	var err error
+	if ret := sspi.DeleteSecurityContext(&ctx.Handle); ret != sspi.SEC_E_OK {
+		err = ret
+	}
+	if ctx.creds != nil {
+		if ret := sspi.FreeCredentialsHandle(&ctx.creds.Handle); ret != sspi.SEC_E_OK && err == nil {
+			err = ret
+		}
+	}
+	return err
+}
+
 func gssapi(spn string) Mechanism {
 	return Mechanism{
-		Name: "GSSAPI",
+		Name:       "GSSAPI",
+		Properties: NoPlaintext | MutualAuth,
+		Close:      releaseContext,
 		Start: func(m *Negotiator) (bool, []byte, interface{}, error) {
 
-			ctx := context{RequestedFlags: sspi.ISC_REQ_MUTUAL_AUTH |
+			ctx := secContext{RequestedFlags: sspi.ISC_REQ_MUTUAL_AUTH |
 				sspi.ISC_REQ_ALLOCATE_MEMORY |
 				sspi.ISC_REQ_CONFIDENTIALITY |
 				sspi.ISC_REQ_REPLAY_DETECT}
@@ -81,15 +104,14 @@ func gssapi(spn string) Mechanism {
 				return false, nil, nil, ErrInvalidChallenge
 			}
 
-			ctx, ok := data.(context)
+			ctx, ok := data.(secContext)
 			if !ok {
 				return false, nil, nil, errors.New("invalid context")
 			}
+			// Always hand the context back to the negotiator so that it can be
+			// released with releaseContext when the negotiation ends.
 			defer func() {
-				if err != nil {
-					sspi.FreeCredentialsHandle(&ctx.creds.Handle)
-					sspi.DeleteSecurityContext(&ctx.Handle)
-				}
+				cache = ctx
 			}()
 
 			state := m.State()
@@ -177,3 +199,134 @@ func gssapi(spn string) Mechanism {
 		},
 	}
 }
+
+// Values from the Windows SDK that are not defined by the sspi package.
+const (
+	secbufferChannelBindings = 14
+	secpkgAttrNames          = 1
+
+	// secChannelBindingsLen is the size of the SEC_CHANNEL_BINDINGS structure.
+	secChannelBindingsLen = 32
+)
+
+// krb5Context is a GSSContext for Kerberos V5 backed by SSPI.
+type krb5Context struct {
+	server bool
+	spn    *uint16
+	creds  *sspi.Credentials
+	handle *sspi.CtxtHandle
+	// bindings is a SEC_CHANNEL_BINDINGS structure followed by the application
+	// data.
+	bindings []byte
+	flags    uint32
+	expiry   syscall.Filetime
+}
+
+func newKRB5Context(spn string) func(*Negotiator, asn1.ObjectIdentifier, []byte) (GSSContext, error) {
+	return func(n *Negotiator, _ asn1.ObjectIdentifier, bindings []byte) (GSSContext, error) {
+		c := &krb5Context{server: n.State()&Receiving == Receiving}
+		use := uint32(sspi.SECPKG_CRED_OUTBOUND)
+		if c.server {
+			use = sspi.SECPKG_CRED_INBOUND
+		} else {
+			target, err := syscall.UTF16PtrFromString(spn)
+			if err != nil {
+				return nil, errors.New("faild to get spn")
+			}
+			c.spn = target
+		}
+		creds, err := sspi.AcquireCredentials("", sspi.MICROSOFT_KERBEROS_NAME, use, nil)
+		if err != nil {
+			return nil, errors.New("failed to acquire credentials")
+		}
+		c.creds = creds
+
+		// Only the application data is used, so it is the only field of the
+		// SEC_CHANNEL_BINDINGS structure that is set.
+		c.bindings = make([]byte, secChannelBindingsLen, secChannelBindingsLen+len(bindings))
+		binary.LittleEndian.PutUint32(c.bindings[24:], uint32(len(bindings)))
+		binary.LittleEndian.PutUint32(c.bindings[28:], secChannelBindingsLen)
+		c.bindings = append(c.bindings, bindings...)
+		return c, nil
+	}
+}
+
+func (c *krb5Context) Step(token []byte) ([]byte, bool, error) {
+	in := make([]sspi.SecBuffer, 0, 2)
+	if len(token) > 0 {
+		in = append(in, sspi.SecBuffer{})
+		in[0].Set(sspi.SECBUFFER_TOKEN, token)
+	}
+	in = append(in, sspi.SecBuffer{})
+	in[len(in)-1].Set(secbufferChannelBindings, c.bindings)
+
+	out := []sspi.SecBuffer{
+		{BufferType: sspi.SECBUFFER_TOKEN},
+	}
+	defer func() {
+		out[0].Free()
+	}()
+
+	var prev *sspi.CtxtHandle
+	if c.handle != nil {
+		prev = c.handle
+	} else {
+		c.handle = new(sspi.CtxtHandle)
+	}
+	var ret syscall.Errno
+	if c.server {
+		ret = sspi.AcceptSecurityContext(&c.creds.Handle, prev, sspi.NewSecBufferDesc(in),
+			sspi.ASC_REQ_MUTUAL_AUTH|sspi.ASC_REQ_ALLOCATE_MEMORY, sspi.SECURITY_NATIVE_DREP,
+			c.handle, sspi.NewSecBufferDesc(out), &c.flags, &c.expiry)
+	} else {
+		ret = sspi.InitializeSecurityContext(&c.creds.Handle, prev, c.spn,
+			sspi.ISC_REQ_MUTUAL_AUTH|sspi.ISC_REQ_ALLOCATE_MEMORY, 0, sspi.SECURITY_NATIVE_DREP,
+			sspi.NewSecBufferDesc(in), 0, c.handle, sspi.NewSecBufferDesc(out), &c.flags, &c.expiry)
+	}
+	if ret != sspi.SEC_E_OK && ret != sspi.SEC_I_CONTINUE_NEEDED {
+		if prev == nil {
+			c.handle = nil
+		}
+		return nil, false, ret
+	}
+
+	tokenB := out[0].Bytes()
+	resp := make([]byte, len(tokenB))
+	copy(resp, tokenB)
+	return resp, ret == sspi.SEC_E_OK, nil
+}
+
+func (c *krb5Context) Peer() ([]byte, error) {
+	if !c.server || c.handle == nil {
+		return nil, ErrInvalidState
+	}
+	var names struct {
+		UserName *uint16
+	}
+	ret := sspi.QueryContextAttributes(c.handle, secpkgAttrNames, (*byte)(unsafe.Pointer(&names)))
+	if ret != sspi.SEC_E_OK {
+		return nil, ret
+	}
+	defer sspi.FreeContextBuffer((*byte)(unsafe.Pointer(names.UserName)))
+
+	// The name is a NUL terminated UTF-16 string.
+	name := (*[1 << 20]uint16)(unsafe.Pointer(names.UserName))[:]
+	return []byte(syscall.UTF16ToString(name)), nil
+}
+
+func (c *krb5Context) Close() error {
+	var err error
+	if c.handle != nil {
+		if ret := sspi.DeleteSecurityContext(c.handle); ret != sspi.SEC_E_OK {
+			err = ret
+		}
+		c.handle = nil
+	}
+	if c.creds != nil {
+		if ret := sspi.FreeCredentialsHandle(&c.creds.Handle); ret != sspi.SEC_E_OK && err == nil {
+			err = ret
+		}
+		c.creds = nil
+	}
+	return err
+}
@@ -0,0 +1,118 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"hash"
+)
+
+var (
+	htInitiator = []byte("Initiator")
+	htResponder = []byte("Responder")
+)
+
+// ht returns a mechanism from the HT family defined in
+// draft-schmaus-kitten-sasl-ht.
+// If cbType is empty the mechanism does not use channel binding.
+func ht(name string, fn func() hash.Hash, cbType string) Mechanism {
+	props := NoPlaintext | NoDictionary | MutualAuth
+	if cbType != "" {
+		props |= ChannelBinding
+	}
+	return Mechanism{
+		Name:       name,
+		Properties: props,
+		Start: func(m *Negotiator) (more bool, resp []byte, cache interface{}, err error) {
+			cbData, err := htChannelBinding(m, cbType)
+			if err != nil {
+				return false, nil, nil, err
+			}
+			username, token, _ := m.Credentials()
+
+			resp = append(resp, username...)
+			resp = append(resp, 0)
+			resp = append(resp, htHMAC(fn, token, htInitiator, cbData)...)
+			return true, resp, htHMAC(fn, token, htResponder, cbData), nil
+		},
+		Next: func(m *Negotiator, challenge []byte, data interface{}) (more bool, resp []byte, cache interface{}, err error) {
+			if m.State()&StepMask != AuthTextSent {
+				return false, nil, nil, ErrTooManySteps
+			}
+			if len(challenge) == 0 {
+				return false, nil, nil, ErrInvalidChallenge
+			}
+			if m.State()&Receiving == Receiving {
+				return htServerNext(m, name, fn, cbType, challenge)
+			}
+
+			// The server proves that it knows the token (and is on the same TLS
+			// channel) by returning the responder hash as additional data with
+			// success.
+			expected, ok := data.([]byte)
+			if !ok {
+				return false, nil, nil, ErrInvalidState
+			}
+			if !hmac.Equal(challenge, expected) {
+				return false, nil, nil, ErrAuthn
+			}
+			return false, nil, nil, nil
+		},
+	}
+}
+
+func htServerNext(m *Negotiator, name string, fn func() hash.Hash, cbType string, challenge []byte) (more bool, resp []byte, cache interface{}, err error) {
+	idx := bytes.IndexByte(challenge, 0)
+	if idx < 1 {
+		return false, nil, nil, ErrInvalidChallenge
+	}
+	username, hashedToken := challenge[:idx], challenge[idx+1:]
+
+	cbData, err := htChannelBinding(m, cbType)
+	if err != nil {
+		return false, nil, nil, err
+	}
+	if m.htTokens == nil {
+		return false, nil, nil, ErrAuthn
+	}
+	token, err := m.htTokens(m, name, username)
+	if err != nil {
+		return false, nil, nil, err
+	}
+	if token == nil {
+		return false, nil, nil, ErrAuthn
+	}
+	if !hmac.Equal(hashedToken, htHMAC(fn, token, htInitiator, cbData)) {
+		return false, nil, nil, ErrAuthn
+	}
+
+	if !m.Permissions(Credentials(func() (Username, Password, Identity []byte) {
+		return username, nil, nil
+	})) {
+		return false, nil, nil, ErrAuthn
+	}
+	return false, htHMAC(fn, token, htResponder, cbData), nil, nil
+}
+
+// htChannelBinding returns the channel binding data for the mechanism or nil if
+// it does not use channel binding.
+func htChannelBinding(m *Negotiator, cbType string) ([]byte, error) {
+	if cbType == "" {
+		return nil, nil
+	}
+	if !canBind(m, cbType, m.State()&Receiving == Receiving) {
+		return nil, ErrChannelBinding
+	}
+	return channelBindingData(m, cbType)
+}
+
+// htHMAC computes HMAC(token, label || cbData).
+func htHMAC(fn func() hash.Hash, token, label, cbData []byte) []byte {
+	h := hmac.New(fn, token)
+	h.Write(label)
+	h.Write(cbData)
+	return h.Sum(nil)
+}
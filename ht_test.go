@@ -0,0 +1,170 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"testing"
+)
+
+func htTokens(_ *Negotiator, mechanism string, username []byte) ([]byte, error) {
+	if string(username) == "user" && strings.HasPrefix(mechanism, "HT-SHA-256-") {
+		return []byte("s3cr3tt0k3n"), nil
+	}
+	return nil, nil
+}
+
+func TestHTInitialResponse(t *testing.T) {
+	client := NewClient(HTSha256Uniq, TLSState(scramTLS), Credentials(func() ([]byte, []byte, []byte) {
+		return []byte("user"), []byte("s3cr3tt0k3n"), nil
+	}))
+	more, resp, err := client.Step(nil)
+	if err != nil || !more {
+		t.Fatalf("Unexpected result: more=%v, err=%v", more, err)
+	}
+
+	h := hmac.New(sha256.New, []byte("s3cr3tt0k3n"))
+	h.Write([]byte("Initiator"))
+	h.Write(scramTLS.TLSUnique)
+	want := append([]byte("user\x00"), h.Sum(nil)...)
+	if !bytes.Equal(resp, want) {
+		t.Errorf("Unexpected initial response: want=%x, got=%x", want, resp)
+	}
+
+	h = hmac.New(sha256.New, []byte("s3cr3tt0k3n"))
+	h.Write([]byte("Responder"))
+	h.Write(scramTLS.TLSUnique)
+	more, _, err = client.Step(h.Sum(nil))
+	if err != nil || more {
+		t.Errorf("Unexpected result verifying the server: more=%v, err=%v", more, err)
+	}
+}
+
+func TestHT(t *testing.T) {
+	tls13Client, tls13Server := tlsPair(t, versionTLS13)
+	for _, tc := range [...]struct {
+		name        string
+		mechanism   Mechanism
+		clientState *tls.ConnectionState
+		serverState *tls.ConnectionState
+		serverCert  *x509.Certificate
+		serverOpts  []Option
+		token       string
+		clientErr   error
+		serverErr   error
+	}{
+		{
+			name:      "NONE",
+			mechanism: HTSha256None,
+			token:     "s3cr3tt0k3n",
+		},
+		{
+			name:      "NONE/WrongToken",
+			mechanism: HTSha256None,
+			token:     "wrong",
+			serverErr: ErrAuthn,
+		},
+		{
+			name:        "UNIQ",
+			mechanism:   HTSha256Uniq,
+			clientState: &scramTLS,
+			serverState: &scramTLS,
+			token:       "s3cr3tt0k3n",
+		},
+		{
+			name:        "UNIQ/BindingMismatch",
+			mechanism:   HTSha256Uniq,
+			clientState: &scramTLS,
+			serverState: &tls.ConnectionState{TLSUnique: []byte("other")},
+			token:       "s3cr3tt0k3n",
+			serverErr:   ErrAuthn,
+		},
+		{
+			name:      "UNIQ/NoTLS",
+			mechanism: HTSha256Uniq,
+			token:     "s3cr3tt0k3n",
+			clientErr: ErrChannelBinding,
+		},
+		{
+			name:        "EXPR",
+			mechanism:   HTSha256Expr,
+			clientState: &tls13Client,
+			serverState: &tls13Server,
+			token:       "s3cr3tt0k3n",
+		},
+		{
+			name:        "ENDP",
+			mechanism:   HTSha256Endp,
+			clientState: &tls13Client,
+			serverState: &tls13Server,
+			serverCert:  tls13Client.PeerCertificates[0],
+			token:       "s3cr3tt0k3n",
+		},
+		{
+			name:        "ENDP/NoCertificate",
+			mechanism:   HTSha256Endp,
+			clientState: &tls13Client,
+			serverState: &tls13Server,
+			token:       "s3cr3tt0k3n",
+			serverErr:   ErrChannelBinding,
+		},
+		{
+			// Passwords are never accepted as tokens.
+			name:       "PasswordLookup",
+			mechanism:  HTSha256None,
+			serverOpts: []Option{Secret(func(*Negotiator, []byte) ([]byte, error) { return []byte("s3cr3tt0k3n"), nil })},
+			token:      "s3cr3tt0k3n",
+			serverErr:  ErrAuthn,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			token := tc.token
+			clientOpts := []Option{Credentials(func() ([]byte, []byte, []byte) {
+				return []byte("user"), []byte(token), nil
+			})}
+			serverOpts := tc.serverOpts
+			if serverOpts == nil {
+				serverOpts = []Option{HTTokens(htTokens)}
+			}
+			if tc.serverCert != nil {
+				serverOpts = append(serverOpts, ServerCertificate(tc.serverCert))
+			}
+			if tc.clientState != nil {
+				clientOpts = append(clientOpts, TLSState(*tc.clientState))
+			}
+			if tc.serverState != nil {
+				serverOpts = append(serverOpts, TLSState(*tc.serverState))
+			}
+
+			clientErr, serverErr := stepPair(NewClient(tc.mechanism, clientOpts...), NewServer(tc.mechanism, acceptAll, serverOpts...))
+			if clientErr != tc.clientErr {
+				t.Errorf("Unexpected client error: want=%v, got=%v", tc.clientErr, clientErr)
+			}
+			if serverErr != tc.serverErr {
+				t.Errorf("Unexpected server error: want=%v, got=%v", tc.serverErr, serverErr)
+			}
+		})
+	}
+}
+
+func TestHTServerNotAuthenticated(t *testing.T) {
+	client := NewClient(HTSha256None, Credentials(func() ([]byte, []byte, []byte) {
+		return []byte("user"), []byte("s3cr3tt0k3n"), nil
+	}))
+	_, _, err := client.Step(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A server that does not know the token cannot produce the responder hash.
+	_, _, err = client.Step(bytes.Repeat([]byte{0}, sha256.Size))
+	if err != ErrAuthn {
+		t.Errorf("Unexpected error: want=%v, got=%v", ErrAuthn, err)
+	}
+}
@@ -16,6 +16,40 @@ var (
 	ErrInvalidChallenge = errors.New("Invalid or missing challenge")
 	ErrAuthn            = errors.New("Authentication error")
 	ErrTooManySteps     = errors.New("Step called too many times")
+	ErrNoMechanism      = errors.New("No acceptable mechanism")
+	ErrPolicy           = errors.New("Mechanism not allowed by policy")
+	ErrDowngrade        = errors.New("Possible downgrade attack detected")
+	ErrChannelBinding   = errors.New("No mutually supported channel binding type")
+)
+
+// Property is a set of security properties of a mechanism, as described in
+// RFC 4422 and used by Cyrus SASL.
+type Property uint8
+
+// The security properties that a mechanism may have.
+const (
+	// NoPlaintext mechanisms do not reveal the password to passive attackers.
+	NoPlaintext Property = 1 << iota
+
+	// NoDictionary mechanisms are not susceptible to offline dictionary
+	// attacks.
+	NoDictionary
+
+	// MutualAuth mechanisms authenticate the server to the client as well as
+	// the client to the server.
+	MutualAuth
+
+	// ChannelBinding mechanisms bind the authentication to the underlying TLS
+	// channel and can only be used with TLS.
+	ChannelBinding
+
+	// ForwardSecrecy mechanisms do not expose previous sessions if the secret
+	// is later compromised.
+	ForwardSecrecy
+
+	// ClientOnly mechanisms cannot be used by servers.
+	// Server never advertises them.
+	ClientOnly
 )
 
 var (
@@ -24,8 +58,10 @@ var (
 	Plain = plain
 
 	// ScramSha256Plus is a Mechanism that implements the SCRAM-SHA-256-PLUS
-	// authentication mechanism defined in RFC 7677. The only supported channel
-	// binding type is tls-unique as defined in RFC 5929.
+	// authentication mechanism defined in RFC 7677. The channel binding type is
+	// selected using the ChannelBindingTypes option.
+	// Servers using any of the SCRAM mechanisms must provide the stored
+	// credentials of each user with the ScramCredentials option.
 	ScramSha256Plus = scram("SCRAM-SHA-256-PLUS", sha256.New)
 
 	// ScramSha256 is a Mechanism that implements the SCRAM-SHA-256
@@ -33,14 +69,29 @@ var (
 	ScramSha256 = scram("SCRAM-SHA-256", sha256.New)
 
 	// ScramSha1Plus is a Mechanism that implements the SCRAM-SHA-1-PLUS
-	// authentication mechanism defined in RFC 5802. The only supported channel
-	// binding type is tls-unique as defined in RFC 5929.
+	// authentication mechanism defined in RFC 5802. The channel binding type is
+	// selected using the ChannelBindingTypes option.
 	ScramSha1Plus = scram("SCRAM-SHA-1-PLUS", sha1.New)
 
 	// ScramSha1 is a Mechanism that implements the SCRAM-SHA-1 authentication
 	// mechanism defined in RFC 5802.
 	ScramSha1 = scram("SCRAM-SHA-1", sha1.New)
 
+	// CramMD5 is a Mechanism that implements the CRAM-MD5 authentication
+	// mechanism defined in RFC 2195.
+	// Servers using CRAM-MD5 must provide the shared secret for each user with
+	// the Secret option.
+	CramMD5 = cramMD5
+
+	// DigestMD5 returns a Mechanism that implements the client side of the
+	// DIGEST-MD5 authentication mechanism defined in RFC 2831.
+	// The digest URI is the service type and host name of the server, for
+	// example "ldap/ldap.example.net".
+	// Only qop=auth is supported.
+	// DIGEST-MD5 has been deprecated by RFC 6331 and should only be used to
+	// communicate with legacy servers.
+	DigestMD5 = digestMD5
+
 	// GSSAPI is a Mechanism that implements the GSSAPI authentication
 	// mechanism defined in RFC 4752.
 	GSSAPI = gssapi
@@ -51,6 +102,72 @@ var (
 
 	//NTLM is a Mechanism that implements  Microsoft NTLM
 	NTLM = ntlm
+
+	// HTSha256None, HTSha256Uniq, HTSha256Endp, and HTSha256Expr are
+	// Mechanisms that implement the HT-SHA-256 family of token authentication
+	// mechanisms used by XEP-0484 (FAST).
+	// The NONE variant does not use channel binding, and the others use the
+	// tls-unique, tls-server-end-point, and tls-exporter channel binding types
+	// respectively.
+	// The token is sent as the password of the Credentials option, and servers
+	// look it up with the HTTokens option.
+	// Servers using HT-SHA-256-ENDP must provide their certificate with the
+	// ServerCertificate option.
+	HTSha256None = ht("HT-SHA-256-NONE", sha256.New, "")
+	HTSha256Uniq = ht("HT-SHA-256-UNIQ", sha256.New, cbTLSUnique)
+	HTSha256Endp = ht("HT-SHA-256-ENDP", sha256.New, cbTLSServerEndPoint)
+	HTSha256Expr = ht("HT-SHA-256-EXPR", sha256.New, cbTLSExporter)
+
+	// OTP returns a Mechanism that implements the OTP authentication mechanism
+	// defined in RFC 2444 using the one-time passwords from RFC 2289.
+	// Clients use the password from the Credentials option as the pass phrase,
+	// and servers must provide an OTPStore in the config.
+	// The md5 and sha1 algorithms are supported.
+	OTP = otp
+
+	// EcdsaNist256pChallenge returns a Mechanism that implements the
+	// ECDSA-NIST256P-CHALLENGE mechanism used by IRC services such as Atheme.
+	// Clients sign a random challenge using the private key from the config,
+	// and servers verify the signature using the public key that it looks up.
+	EcdsaNist256pChallenge = ecdsaNIST256PChallenge
+
+	// SAML20 returns a Mechanism that implements the SAML20 authentication
+	// mechanism defined in RFC 6595.
+	// Clients send the identity provider identifier as the username of the
+	// Credentials option and must provide a Browser in the config to visit the
+	// URL sent by the server.
+	// Servers act as a service provider using the rest of the config.
+	// Channel binding is not supported.
+	SAML20 = saml20
+
+	// OpenID20 returns a Mechanism that implements the OPENID20 authentication
+	// mechanism defined in RFC 6616.
+	// Clients send their OpenID identifier as the username of the Credentials
+	// option and must provide a Browser in the config to visit the URL sent by
+	// the server.
+	// Servers act as a relying party using the rest of the config.
+	// Channel binding is not supported.
+	OpenID20 = openID20
+
+	// GS2KRB5Plus and GS2KRB5 return Mechanisms that implement the
+	// GS2-KRB5-PLUS and GS2-KRB5 authentication mechanisms defined in RFC 5801
+	// using Kerberos V5.
+	// Clients authenticate to the service principal spn, which is ignored by
+	// servers.
+	// Unless another implementation is provided with the GSS option, the
+	// systems GSS-API library (or SSPI on Windows) is used.
+	// GS2 can be used to bridge other GSS-API mechanisms.
+	GS2KRB5Plus = gs2KRB5Plus
+	GS2KRB5     = gs2KRB5
+
+	// Passkey returns a Mechanism that implements a PASSKEY authentication
+	// mechanism based on WebAuthn assertions, along the lines of the SASL
+	// passkey drafts.
+	// The server sends a WebAuthn challenge and the client returns an assertion
+	// from the Authenticator in the config.
+	// Servers act as a relying party using the rest of the config.
+	// Only ES256 credentials are supported.
+	Passkey = passkey
 )
 
 // Mechanism represents a SASL mechanism that can be used by a Client or Server
@@ -62,8 +179,28 @@ var (
 // anything that it needs to store and the value will be cached by the
 // negotiator and passed in as the data parameter when the next challenge is
 // received.
+//
+// Most mechanisms are client-first: Start is called by clients to generate the
+// initial response and Next is used for every step after that on both sides.
+// If ServerFirst is set the roles are reversed: Start is called by servers to
+// generate the initial challenge and clients receive it by calling Next before
+// they have sent anything.
+//
+// If the cached state holds resources that must be released (such as handles
+// from a GSS-API library) the mechanism should set Close and keep returning
+// the state from every step, including the last one and any that fail.
+// The negotiator calls Close with the cached state once the negotiation
+// completes or fails, and when it is reset or closed part way through.
+//
+// Properties describes the security properties of the mechanism and is used
+// to decide whether a Policy allows the mechanism to be used.
+// If it is zero the properties are unknown and the mechanism is assumed to
+// reveal the password.
 type Mechanism struct {
-	Name  string
-	Start func(n *Negotiator) (more bool, resp []byte, cache interface{}, err error)
-	Next  func(n *Negotiator, challenge []byte, data interface{}) (more bool, resp []byte, cache interface{}, err error)
+	Name        string
+	Properties  Property
+	ServerFirst bool
+	Start       func(n *Negotiator) (more bool, resp []byte, cache interface{}, err error)
+	Next        func(n *Negotiator, challenge []byte, data interface{}) (more bool, resp []byte, cache interface{}, err error)
+	Close       func(n *Negotiator, data interface{}) error
 }
@@ -4,7 +4,8 @@ package sasl
 
 func negotiate(spn string) Mechanism {
 	return Mechanism{
-		Name: "GSS-SPGENO",
+		Name:       "GSS-SPGENO",
+		Properties: NoPlaintext | MutualAuth,
 		Start: func(m *Negotiator) (bool, []byte, interface{}, error) {
 			return false, nil, nil, nil
 		},
@@ -5,8 +5,11 @@
 package sasl
 
 import (
+	"context"
 	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
 	"strings"
 )
 
@@ -65,7 +68,11 @@ func NewServer(m Mechanism, permissions func(*Negotiator) bool, opts ...Option)
 	machine := &Negotiator{
 		mechanism: m,
 		nonce:     nonce(noncerandlen, rand.Reader),
-		state:     AuthTextSent | Receiving,
+		state:     Receiving,
+	}
+	// Skip the start step for servers unless the mechanism is server-first.
+	if !m.ServerFirst {
+		machine.state |= AuthTextSent
 	}
 	getOpts(machine, opts...)
 	if permissions != nil {
@@ -87,12 +94,32 @@ func NewServer(m Mechanism, permissions func(*Negotiator) bool, opts ...Option)
 type Negotiator struct {
 	tlsState         *tls.ConnectionState
 	remoteMechanisms []string
+	advertised       []string
 	credentials      func() (Username, Password, Identity []byte)
 	permissions      func(*Negotiator) bool
+	secret           func(n *Negotiator, username []byte) ([]byte, error)
+	scramCredentials func(n *Negotiator, mechanism string, username []byte) (*ScramCredential, error)
+	htTokens         func(n *Negotiator, mechanism string, username []byte) ([]byte, error)
+	serverCert       *x509.Certificate
 	mechanism        Mechanism
 	state            State
 	nonce            []byte
 	cache            interface{}
+	round            int
+	maxSteps         int
+	ctx              context.Context
+	policy           *Policy
+	ssdp             bool
+	cbTypes          []string
+	tasks            []Mechanism
+	inline           []string
+	userAgent        [3]string
+	primary          *Mechanism
+	done             bool
+	requested        bool
+	secondFactor     func(n *Negotiator) ([]byte, error)
+	verifyFactor     func(n *Negotiator, username, code []byte) (bool, error)
+	gss              func(n *Negotiator, mech asn1.ObjectIdentifier, bindings []byte) (GSSContext, error)
 }
 
 // Nonce returns a unique nonce that is reset for each negotiation attempt. It
@@ -101,22 +128,125 @@ func (c *Negotiator) Nonce() []byte {
 	return c.nonce
 }
 
+// Round returns the number of times Step has been called since the state
+// machine was created or last reset.
+// Unlike the step bits of the state, which stop at ValidServerResponse, the
+// round keeps counting so that mechanisms with an arbitrary number of round
+// trips can tell which one they are on.
+// While a mechanism is being called the current step has not yet been counted.
+func (c *Negotiator) Round() int {
+	return c.round
+}
+
+// Context returns the context that was passed to StepContext for the step
+// currently being performed.
+// Mechanisms, and callbacks such as the permissions and secret functions, should
+// use it to abort any work that may block.
+// Outside of a step, or when Step was used, it returns context.Background().
+func (c *Negotiator) Context() context.Context {
+	if c.ctx != nil {
+		return c.ctx
+	}
+	return context.Background()
+}
+
 // Step attempts to transition the state machine to its next state. If Step is
 // called after a previous invocation generates an error (and the state machine
 // has not been reset to its initial state), Step panics.
+// If the MaxSteps option was used and Step has already been called that many
+// times, ErrTooManySteps is returned without calling the mechanism.
+// Similarly, if the Enforce option was used and the policy does not allow the
+// mechanism, the first step returns ErrPolicy.
+//
+// When a server returns more == false the negotiation has succeeded and resp is
+// any additional data to send to the client along with the success message (for
+// example the final SCRAM message, which SASL2 sends in the additional-data
+// element).
+// Clients must still pass the additional data to Step to finish the
+// negotiation and authenticate the server.
+//
+// Step is the same as calling StepContext with context.Background().
 func (c *Negotiator) Step(challenge []byte) (more bool, resp []byte, err error) {
+	return c.StepContext(context.Background(), challenge)
+}
+
+// StepContext is like Step except that the context is made available to the
+// mechanism and to any callbacks through the Context method.
+// If the context is canceled or its deadline passes before the step, the
+// mechanism is not called, the state machine is put in the errored state, and
+// the error from the context (context.Canceled or context.DeadlineExceeded) is
+// returned.
+// If it happens during the step and the step fails, the error from the context
+// is returned instead of the error from the mechanism.
+// A step that succeeds is never reported as canceled since its side effects
+// (such as calling the permissions function) have already happened.
+// Mechanisms are responsible for aborting any blocking work themselves.
+func (c *Negotiator) StepContext(ctx context.Context, challenge []byte) (more bool, resp []byte, err error) {
 	if c.state&Errored == Errored {
 		panic("sasl: Step called on a SASL state machine that has errored")
 	}
-	defer func() {
-		if err != nil {
-			c.state |= Errored
+
+	if err = c.canStep(ctx); err == nil {
+		more, resp, err = c.step(ctx, challenge)
+	}
+
+	// If the context was canceled while the mechanism was running and it
+	// failed, report that instead of whatever error the mechanism returned so
+	// that the two can be distinguished.
+	if e := ctx.Err(); err != nil && e != nil {
+		err = e
+	}
+	// Every way of finishing the negotiation, including failing before the
+	// mechanism was called, releases the cached state.
+	if err != nil || !more {
+		if e := c.release(); err == nil {
+			err = e
 		}
+	}
+	if err != nil {
+		c.state |= Errored
+		return false, nil, err
+	}
+	c.done = !more
+	return more, resp, nil
+}
+
+// canStep reports whether the mechanism may be called for the next step.
+func (c *Negotiator) canStep(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if c.maxSteps > 0 && c.round >= c.maxSteps {
+		return ErrTooManySteps
+	}
+	if c.round == 0 && c.primary == nil && c.policy != nil && !c.policy.Allowed(c.mechanism, c.tlsState) {
+		return ErrPolicy
+	}
+	return nil
+}
+
+// step calls the mechanism and advances the state machine.
+func (c *Negotiator) step(ctx context.Context, challenge []byte) (more bool, resp []byte, err error) {
+	c.ctx = ctx
+	defer func() {
+		c.ctx = nil
 	}()
 
 	switch c.state & StepMask {
 	case Initial:
-		more, resp, c.cache, err = c.mechanism.Start(c)
+		switch {
+		case !c.mechanism.ServerFirst:
+			more, resp, c.cache, err = c.mechanism.Start(c)
+		case c.state&Receiving == Receiving:
+			// Server-first mechanisms do not allow an initial response.
+			if len(challenge) > 0 {
+				err = ErrInvalidChallenge
+				break
+			}
+			more, resp, c.cache, err = c.mechanism.Start(c)
+		default:
+			more, resp, c.cache, err = c.mechanism.Next(c, challenge, c.cache)
+		}
 		c.state = c.state&^StepMask | AuthTextSent
 	case AuthTextSent:
 		more, resp, c.cache, err = c.mechanism.Next(c, challenge, c.cache)
@@ -127,11 +257,30 @@ func (c *Negotiator) Step(challenge []byte) (more bool, resp []byte, err error)
 	case ValidServerResponse:
 		more, resp, c.cache, err = c.mechanism.Next(c, challenge, c.cache)
 	}
+	c.round++
+	return more, resp, err
+}
 
-	if err != nil {
-		return false, nil, err
+// release calls the mechanisms Close function (if any) on the cached state and
+// clears the cache.
+func (c *Negotiator) release() error {
+	cache := c.cache
+	c.cache = nil
+	if cache == nil || c.mechanism.Close == nil {
+		return nil
 	}
-	return more, resp, err
+	return c.mechanism.Close(c, cache)
+}
+
+// Close releases any resources held by the mechanism for the current
+// negotiation attempt.
+// Resources are released automatically when a negotiation completes or fails,
+// so Close only needs to be called when a negotiation is abandoned part way
+// through.
+// It is safe to call Close more than once, and the state machine may still be
+// reset and reused afterwards.
+func (c *Negotiator) Close() error {
+	return c.release()
 }
 
 // State returns the internal state of the SASL state machine.
@@ -141,16 +290,34 @@ func (c *Negotiator) State() State {
 
 // Reset resets the state machine to its initial state so that it can be reused
 // in another SASL exchange.
+// Any resources held by the mechanism for the previous attempt are released.
+// If a task was started, the state machine goes back to the original mechanism.
 func (c *Negotiator) Reset() {
+	// There is nothing useful we can do with an error here, the resources are
+	// abandoned either way.
+	_ = c.release()
+
+	if c.primary != nil {
+		c.mechanism = *c.primary
+		c.primary = nil
+	}
+	c.restart()
+}
+
+// restart puts the state machine back in its initial state for the current
+// mechanism.
+func (c *Negotiator) restart() {
 	c.state = c.state & (Receiving | RemoteCB)
 
-	// Skip the start step for servers
-	if c.state&Receiving == Receiving {
+	// Skip the start step for servers unless the mechanism is server-first.
+	if c.state&Receiving == Receiving && !c.mechanism.ServerFirst {
 		c.state = c.state&^StepMask | AuthTextSent
 	}
 
 	c.nonce = nonce(noncerandlen, rand.Reader)
-	c.cache = nil
+	c.round = 0
+	c.done = false
+	c.requested = false
 }
 
 // Credentials returns a username, and password for authentication and optional
@@ -162,6 +329,16 @@ func (c *Negotiator) Credentials() (username, password, identity []byte) {
 	return
 }
 
+// Secret looks up the shared secret for username using the function provided
+// by the Secret option.
+// If no function was provided, or the user does not exist, the secret is nil.
+func (c *Negotiator) Secret(username []byte) ([]byte, error) {
+	if c.secret != nil {
+		return c.secret(c, username)
+	}
+	return nil, nil
+}
+
 // Permissions is the callback used by the server to authenticate the user.
 func (c *Negotiator) Permissions(opts ...Option) bool {
 	if c.permissions != nil {
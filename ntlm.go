@@ -4,7 +4,8 @@ package sasl
 
 func ntlm(spn string) Mechanism {
 	return Mechanism{
-		Name: "GSS-SPGENO",
+		Name:       "GSS-SPGENO",
+		Properties: NoPlaintext,
 		Start: func(m *Negotiator) (bool, []byte, interface{}, error) {
 			return false, nil, nil, nil
 		},
@@ -11,10 +11,12 @@ import (
 
 func ntlm(spn string) Mechanism {
 	return Mechanism{
-		Name: "GSS-SPGENO",
+		Name:       "GSS-SPGENO",
+		Properties: NoPlaintext,
+		Close:      releaseContext,
 		Start: func(m *Negotiator) (bool, []byte, interface{}, error) {
 
-			ctx := context{RequestedFlags: sspi.ISC_REQ_MUTUAL_AUTH |
+			ctx := secContext{RequestedFlags: sspi.ISC_REQ_MUTUAL_AUTH |
 				sspi.ISC_REQ_ALLOCATE_MEMORY} // |
 			// sspi.ISC_REQ_CONFIDENTIALITY |
 			// sspi.ISC_REQ_REPLAY_DETECT}
@@ -62,15 +64,14 @@ func ntlm(spn string) Mechanism {
 				return false, nil, nil, ErrInvalidChallenge
 			}
 
-			ctx, ok := data.(context)
+			ctx, ok := data.(secContext)
 			if !ok {
 				return false, nil, nil, errors.New("invalid context")
 			}
+			// Always hand the context back to the negotiator so that it can be
+			// released with releaseContext when the negotiation ends.
 			defer func() {
-				if err != nil {
-					sspi.FreeCredentialsHandle(&ctx.creds.Handle)
-					sspi.DeleteSecurityContext(&ctx.Handle)
-				}
+				cache = ctx
 			}()
 
 			state := m.State()
@@ -0,0 +1,88 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"net/url"
+)
+
+const openIDNS = "http://specs.openid.net/auth/2.0"
+
+// OpenIDConfig configures the OPENID20 mechanism.
+// Clients only use Browser, and servers, which act as an OpenID 2.0 relying
+// party, use the other fields.
+type OpenIDConfig struct {
+	// Browser is used by clients to send the user to the URL returned by the
+	// server.
+	// It should open the URL in a web browser (or instruct the user to do so)
+	// and return once the user has finished authenticating with the OpenID
+	// provider.
+	// If the user may never finish, it should stop waiting when the context
+	// returned by the negotiators Context method is canceled.
+	Browser func(n *Negotiator, url string) error
+
+	// Realm is the URL pattern that the OpenID provider asks the user to trust.
+	Realm string
+
+	// ReturnTo is the URL that the OpenID provider sends its assertion to.
+	// Receiving the assertion is up to the application.
+	ReturnTo string
+
+	// Endpoint performs discovery on the identifier sent by the client and
+	// returns the OpenID provider endpoint URL.
+	// If the identifier is invalid, or the provider is not trusted, it should
+	// return an error.
+	Endpoint func(n *Negotiator, identifier []byte) (endpoint string, err error)
+
+	// VerifyAssertion is called once the client reports that the user has
+	// finished authenticating.
+	// It should wait for the assertion about identifier to arrive at ReturnTo,
+	// verify it with the OpenID provider, and return the verified claimed
+	// identifier.
+	// If no positive assertion was received it should return a nil identifier
+	// or an error.
+	// The error message is sent to the client.
+	VerifyAssertion func(n *Negotiator, identifier []byte) (claimedID []byte, err error)
+}
+
+func openID20(c OpenIDConfig) Mechanism {
+	var server *redirectServer
+	if c.Endpoint != nil && c.VerifyAssertion != nil {
+		server = &redirectServer{
+			redirect: func(n *Negotiator, identifier []byte) (string, interface{}, error) {
+				endpoint, err := c.Endpoint(n, identifier)
+				if err != nil {
+					return "", nil, err
+				}
+				redirect, err := openIDRedirect(&c, endpoint, identifier)
+				return redirect, nil, err
+			},
+			verify: func(n *Negotiator, identifier []byte, _ interface{}) ([]byte, error) {
+				return c.VerifyAssertion(n, identifier)
+			},
+		}
+	}
+	return redirectMechanism("OPENID20", "openid.error=", c.Browser, server)
+}
+
+// openIDRedirect builds a checkid_setup request for the identifier, which is
+// used as both the claimed identifier and the OP-local identifier.
+func openIDRedirect(c *OpenIDConfig, endpoint string, identifier []byte) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("openid.ns", openIDNS)
+	q.Set("openid.mode", "checkid_setup")
+	q.Set("openid.claimed_id", string(identifier))
+	q.Set("openid.identity", string(identifier))
+	q.Set("openid.return_to", c.ReturnTo)
+	if c.Realm != "" {
+		q.Set("openid.realm", c.Realm)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"errors"
+	"net/url"
+	"testing"
+)
+
+const (
+	testOPEndpoint = "https://openid.example.net/server"
+	testReturnTo   = "https://rp.example.com/openid"
+	testRealm      = "https://rp.example.com/"
+)
+
+var errCanceled = errors.New("user canceled")
+
+// openIDProvider is a stand-in OpenID provider.
+// Its browser function plays the part of the user agent: it checks the
+// checkid_setup request and, if the user approves it, delivers a positive
+// assertion for the identifier to the relying party.
+type openIDProvider struct {
+	t        *testing.T
+	approve  bool
+	received map[string]bool
+}
+
+func (op *openIDProvider) browser(_ *Negotiator, redirect string) error {
+	u, err := url.Parse(redirect)
+	if err != nil {
+		return err
+	}
+	q := u.Query()
+	if u.Scheme+"://"+u.Host+u.Path != testOPEndpoint ||
+		q.Get("openid.ns") != openIDNS ||
+		q.Get("openid.mode") != "checkid_setup" ||
+		q.Get("openid.return_to") != testReturnTo ||
+		q.Get("openid.realm") != testRealm ||
+		q.Get("openid.identity") != q.Get("openid.claimed_id") {
+		op.t.Errorf("Unexpected checkid_setup request: %s", redirect)
+	}
+	if op.approve {
+		op.received[q.Get("openid.claimed_id")] = true
+	}
+	return nil
+}
+
+func (op *openIDProvider) config() OpenIDConfig {
+	return OpenIDConfig{
+		Realm:    testRealm,
+		ReturnTo: testReturnTo,
+		Endpoint: func(_ *Negotiator, identifier []byte) (string, error) {
+			u, err := url.Parse(string(identifier))
+			if err != nil || u.Host != "openid.example.net" {
+				return "", errUnknownIdP
+			}
+			return testOPEndpoint, nil
+		},
+		VerifyAssertion: func(_ *Negotiator, identifier []byte) ([]byte, error) {
+			if !op.received[string(identifier)] {
+				return nil, errCanceled
+			}
+			delete(op.received, string(identifier))
+			return identifier, nil
+		},
+	}
+}
+
+func TestOpenID20(t *testing.T) {
+	const user = "https://openid.example.net/juliet"
+	for _, tc := range [...]struct {
+		name       string
+		identifier string
+		identity   string
+		approve    bool
+		noBrowser  bool
+		clientErr  bool
+		serverErr  error
+	}{
+		{name: "Valid", identifier: user, approve: true},
+		{name: "Identity", identifier: user, identity: "romeo", approve: true},
+		{name: "Canceled", identifier: user, serverErr: errCanceled},
+		{name: "UnknownProvider", identifier: "https://openid.example.org/juliet", approve: true, serverErr: errUnknownIdP},
+		{name: "NoIdentifier", approve: true, clientErr: true},
+		{name: "NoBrowser", identifier: user, approve: true, noBrowser: true, clientErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			op := &openIDProvider{t: t, approve: tc.approve, received: make(map[string]bool)}
+			identifier, identity := tc.identifier, tc.identity
+			var clientConfig OpenIDConfig
+			if !tc.noBrowser {
+				clientConfig.Browser = op.browser
+			}
+			var gotUser, gotIdentity string
+			perm := func(n *Negotiator) bool {
+				u, _, i := n.Credentials()
+				gotUser, gotIdentity = string(u), string(i)
+				return true
+			}
+			client := NewClient(OpenID20(clientConfig), Credentials(func() ([]byte, []byte, []byte) {
+				return []byte(identifier), nil, []byte(identity)
+			}))
+			server := NewServer(OpenID20(op.config()), perm)
+
+			clientErr, serverErr := stepPair(client, server)
+			if (clientErr != nil) != tc.clientErr {
+				t.Errorf("Unexpected client error: %v", clientErr)
+			}
+			if serverErr != tc.serverErr {
+				t.Errorf("Unexpected server error: want=%v, got=%v", tc.serverErr, serverErr)
+			}
+			if tc.clientErr || tc.serverErr != nil {
+				return
+			}
+			if gotUser != tc.identifier || gotIdentity != tc.identity {
+				t.Errorf("Unexpected credentials: want=%q/%q, got=%q/%q", tc.identifier, tc.identity, gotUser, gotIdentity)
+			}
+		})
+	}
+}
+
+func TestOpenID20Error(t *testing.T) {
+	op := &openIDProvider{t: t, received: make(map[string]bool)}
+	client := NewClient(OpenID20(OpenIDConfig{Browser: op.browser}), Credentials(func() ([]byte, []byte, []byte) {
+		return []byte("https://openid.example.net/juliet"), nil, nil
+	}))
+	server := NewServer(OpenID20(op.config()), acceptAll)
+
+	_, resp, err := client.Step(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, challenge, err := server.Step(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, resp, err = client.Step(challenge); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server reports the error in a challenge that the client must
+	// acknowledge before the negotiation fails.
+	more, challenge, err := server.Step(resp)
+	if err != nil || !more {
+		t.Fatalf("Expected an error challenge, got more=%t, err=%v", more, err)
+	}
+	if want := "openid.error=" + errCanceled.Error(); string(challenge) != want {
+		t.Errorf("Unexpected error challenge: want=%q, got=%q", want, challenge)
+	}
+	more, resp, err = client.Step(challenge)
+	if err != nil || !more || string(resp) != "=" {
+		t.Fatalf("Expected the client to acknowledge the error, got more=%t, resp=%q, err=%v", more, resp, err)
+	}
+	if _, _, err = server.Step(resp); err != errCanceled {
+		t.Errorf("Expected the server to fail with the reported error, got %v", err)
+	}
+}
@@ -6,6 +6,7 @@ package sasl
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 )
 
 // An Option represents an input to a SASL state machine.
@@ -40,6 +41,17 @@ func RemoteMechanisms(m ...string) Option {
 	}
 }
 
+// AdvertisedMechanisms sets the list of mechanisms that a server advertised to
+// the client.
+// Mechanisms which support channel binding use it to detect if an attacker
+// removed the -PLUS variants from the list.
+// Server.Negotiate sets it automatically.
+func AdvertisedMechanisms(m ...string) Option {
+	return func(n *Negotiator) {
+		n.advertised = m
+	}
+}
+
 // Credentials provides the negotiator with a username and password to
 // authenticate with and (optionally) an authorization identity.
 // Identity will normally be left empty to act as the username.
@@ -51,3 +63,178 @@ func Credentials(f func() (Username, Password, Identity []byte)) Option {
 		n.credentials = f
 	}
 }
+
+// Secret provides a server with a way to look up the shared secret (normally
+// the password) for a user.
+// It is used by mechanisms such as CRAM-MD5 where the server must know the
+// secret in order to verify the response sent by the client.
+// If the user does not exist f should return a nil secret and a nil error.
+// If the lookup may block, f should respect the context returned by the
+// negotiators Context method.
+func Secret(f func(n *Negotiator, username []byte) (secret []byte, err error)) Option {
+	return func(n *Negotiator) {
+		n.secret = f
+	}
+}
+
+// ScramCredentials provides a SCRAM server with a way to look up the stored
+// credential of a user.
+// The mechanism is the name of the SCRAM mechanism without the -PLUS suffix,
+// for example "SCRAM-SHA-256", since both variants use the same credentials.
+// If the user does not exist f should return a nil credential and a nil error.
+// If the lookup may block, f should respect the context returned by the
+// negotiators Context method.
+func ScramCredentials(f func(n *Negotiator, mechanism string, username []byte) (*ScramCredential, error)) Option {
+	return func(n *Negotiator) {
+		n.scramCredentials = f
+	}
+}
+
+// HTTokens provides an HT server with a way to look up the token issued to a
+// user, for example as part of XEP-0484 (FAST).
+// The mechanism is the full name of the HT mechanism, for example
+// "HT-SHA-256-EXPR", since tokens are issued for a particular mechanism.
+// Tokens are never looked up with the Secret option so that a password can not
+// be used as a token or a token as a password.
+// If the user does not exist or has no token f should return a nil token and a
+// nil error.
+// If the lookup may block, f should respect the context returned by the
+// negotiators Context method.
+func HTTokens(f func(n *Negotiator, mechanism string, username []byte) (token []byte, err error)) Option {
+	return func(n *Negotiator) {
+		n.htTokens = f
+	}
+}
+
+// ServerCertificate provides a server with the certificate that it presented
+// during the TLS handshake.
+// The connection state of a server does not include its own certificate, so
+// servers can only compute tls-server-end-point channel binding data if this
+// option is used.
+func ServerCertificate(cert *x509.Certificate) Option {
+	return func(n *Negotiator) {
+		n.serverCert = cert
+	}
+}
+
+// MaxSteps limits the number of times Step may be called before the
+// negotiation fails with ErrTooManySteps.
+// It is mostly useful on servers to protect against clients that never finish
+// negotiating.
+// A value of zero or less (the default) means that there is no limit.
+func MaxSteps(n int) Option {
+	return func(c *Negotiator) {
+		c.maxSteps = n
+	}
+}
+
+// Tasks sets the tasks that may be performed with BeginTask once the mechanism
+// has completed successfully.
+// On servers these are the tasks that are offered to the client, and on clients
+// they are the tasks that the client knows how to perform.
+func Tasks(tasks ...Mechanism) Option {
+	return func(n *Negotiator) {
+		n.tasks = tasks
+	}
+}
+
+// InlineFeatures sets the names of the features that are negotiated inline with
+// authentication in SASL2 (XEP-0388), such as resource binding or stream
+// management.
+// On clients they are the features that the client requests, which must have
+// been offered by the server, and on servers they are the features that the
+// client requested.
+// The transport is responsible for encoding the features, the negotiator only
+// makes them available to mechanisms, tasks, and callbacks such as the
+// permissions function.
+func InlineFeatures(features ...string) Option {
+	return func(n *Negotiator) {
+		n.inline = features
+	}
+}
+
+// UserAgent sets the user-agent information sent by SASL2 (XEP-0388) clients.
+// The id is a stable identifier for the client installation (XEP-0388
+// recommends a UUIDv4), and software and device are human readable names of
+// the client software and the device it runs on.
+// Any of them may be empty.
+// On clients it is the information that the client sends, and on servers it is
+// the information that the client sent, which may be used to look up
+// credentials that are bound to a particular client, such as the tokens of
+// XEP-0484.
+// As with InlineFeatures, encoding it is left to the transport.
+func UserAgent(id, software, device string) Option {
+	return func(n *Negotiator) {
+		n.userAgent = [3]string{id, software, device}
+	}
+}
+
+// ChannelBindingTypes sets the channel binding types supported by the remote
+// server, for example as advertised using XEP-0440.
+// Clients will use the most secure type that they also support, preferring
+// tls-exporter, then tls-server-end-point, then tls-unique.
+// If none of the types can be used on the current connection, the negotiation
+// fails with ErrChannelBinding.
+// If this option is not used clients assume that the server supports
+// tls-unique, or tls-exporter on TLS 1.3 where tls-unique is not defined.
+//
+// On servers it sets the channel binding types that clients are allowed to
+// use.
+// Types that can not be computed on the current connection, such as
+// tls-server-end-point without the ServerCertificate option, are not accepted
+// and should not be advertised; Server.ChannelBindingTypes returns the list
+// that should be.
+// If this option is not used servers accept any type that they can compute but
+// do not advertise any.
+func ChannelBindingTypes(types ...string) Option {
+	return func(n *Negotiator) {
+		n.cbTypes = types
+	}
+}
+
+// DowngradeProtection enables the SCRAM downgrade protection defined in
+// XEP-0474.
+// The server includes a hash of the mechanisms it advertised and the channel
+// binding types it supports in its first message, and the client verifies it
+// against the lists set with RemoteMechanisms and ChannelBindingTypes.
+// If an attacker modified either list, the negotiation fails with
+// ErrDowngrade.
+//
+// On servers the lists are the ones set with AdvertisedMechanisms and the
+// channel binding types from ChannelBindingTypes that the server can verify on
+// the current connection (see Server.ChannelBindingTypes).
+//
+// Clients accept servers that do not send the hash, even if RemoteMechanisms
+// was used, because not every server supports XEP-0474.
+// The downgrade is therefore only detected if the server supports it.
+// An attacker can not remove the hash sent by a server that does, because the
+// message is covered by the proofs of both sides and the negotiation would
+// fail.
+func DowngradeProtection() Option {
+	return func(n *Negotiator) {
+		n.ssdp = true
+	}
+}
+
+// SecondFactor provides a SCRAM client with a second authentication factor,
+// such as a TOTP or HOTP code, which is sent in the t attribute of the final
+// client message.
+// Because the attribute is covered by the client proof, it cannot be modified
+// or replayed with a different proof by an attacker.
+// The code must not contain a comma.
+func SecondFactor(f func(n *Negotiator) (code []byte, err error)) Option {
+	return func(n *Negotiator) {
+		n.secondFactor = f
+	}
+}
+
+// VerifySecondFactor requires SCRAM clients to send a second authentication
+// factor (see SecondFactor) and uses f to validate it.
+// F is only called after the client has proven that it knows the password and
+// the negotiation fails with ErrAuthn if the code is missing or f reports that
+// it is invalid.
+func VerifySecondFactor(f func(n *Negotiator, username, code []byte) (ok bool, err error)) Option {
+	return func(n *Negotiator) {
+		n.verifyFactor = f
+	}
+}
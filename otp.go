@@ -0,0 +1,502 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// The range of sequence numbers that OTP clients compute a password for if the
+// OTPConfig does not set one.
+const (
+	otpMinSequence = 10
+	otpMaxSequence = 9999
+)
+
+// otpMockKey is used to derive the challenge sent to clients that try to log in
+// as users that do not exist.
+var otpMockKey = nonce(32, rand.Reader)
+
+// OTPState is the state of a users RFC 2289 one-time password sequence as
+// stored by a server.
+type OTPState struct {
+	// Algorithm is the hash algorithm, either "md5" or "sha1".
+	Algorithm string
+
+	// Sequence is the sequence number of the next password to request.
+	// Once it drops below zero the sequence must be reinitialized out of band.
+	Sequence int
+
+	// Seed is sent to the client with the sequence number.
+	// It must be 1 to 16 alphanumeric characters.
+	Seed string
+
+	// Key is the last password that was accepted (or the one used to
+	// initialize the sequence), ie. the password with sequence number
+	// Sequence+1.
+	Key [8]byte
+}
+
+// An OTPStore is used by OTP servers to look up and update the one-time
+// password sequences of users.
+type OTPStore interface {
+	// Lookup returns the current state of the users sequence.
+	// If the user does not exist it should return a nil state and a nil error.
+	Lookup(n *Negotiator, username []byte) (*OTPState, error)
+
+	// Update stores the new state of the users sequence after a password has
+	// been accepted.
+	// To prevent passwords from being replayed, it should fail if the state has
+	// been changed by another negotiation since it was looked up.
+	Update(n *Negotiator, username []byte, state OTPState) error
+}
+
+// OTPConfig configures the OTP mechanism.
+type OTPConfig struct {
+	// Store is used by servers to look up and update each users password
+	// sequence.
+	Store OTPStore
+
+	// SixWord makes clients send passwords in the six-word format instead of
+	// hexadecimal.
+	SixWord bool
+
+	// Reinit, if set, makes clients reinitialize their sequence using the
+	// init-hex or init-word extended response from RFC 2243 after
+	// authenticating with the current sequence.
+	Reinit *OTPReinit
+
+	// MinSequence and MaxSequence are the lowest and highest sequence numbers
+	// that clients will compute a password for.
+	// A server that asks for a lower sequence number than expected may be an
+	// attacker trying to learn a password that it can use to compute all of the
+	// passwords with higher numbers (the "small n" attack from RFC 2289 §9),
+	// and a very high number makes the client do a lot of work.
+	// If they are zero, 10 and 9999 are used.
+	// A negative MinSequence allows any sequence number down to zero.
+	MinSequence int
+	MaxSequence int
+}
+
+// OTPReinit is the new sequence that an OTP client switches to.
+// The new sequence uses the same algorithm as the current one.
+type OTPReinit struct {
+	Sequence int
+	Seed     string
+
+	// Passphrase is the pass phrase of the new sequence.
+	// If it is nil the password from the Credentials option is reused.
+	Passphrase []byte
+}
+
+// otpServerState is cached by servers between the challenge and response.
+type otpServerState struct {
+	username []byte
+	identity []byte
+	state    OTPState
+	// mock is set if the user does not exist (or can not log in) and the
+	// challenge was made up.
+	mock bool
+}
+
+func otp(c OTPConfig) Mechanism {
+	return Mechanism{
+		Name:       "OTP",
+		Properties: NoPlaintext,
+		Start: func(m *Negotiator) (more bool, resp []byte, cache interface{}, err error) {
+			username, _, identity := m.Credentials()
+			resp = append(resp, identity...)
+			resp = append(resp, 0)
+			resp = append(resp, username...)
+			return true, resp, nil, nil
+		},
+		Next: func(m *Negotiator, challenge []byte, data interface{}) (more bool, resp []byte, cache interface{}, err error) {
+			if m.State()&Receiving == Receiving {
+				return otpServerNext(c, m, challenge, data)
+			}
+
+			switch m.State() & StepMask {
+			case AuthTextSent:
+				resp, err = otpClientResponse(c, m, challenge)
+				return err == nil, resp, nil, err
+			case ResponseSent:
+				// The server does not send any additional data with success.
+				if len(challenge) > 0 {
+					return false, nil, nil, ErrInvalidChallenge
+				}
+				return false, nil, nil, nil
+			}
+			return false, nil, nil, ErrTooManySteps
+		},
+	}
+}
+
+func otpClientResponse(c OTPConfig, m *Negotiator, challenge []byte) ([]byte, error) {
+	algorithm, sequence, seed, ext, err := parseOTPChallenge(challenge)
+	if err != nil {
+		return nil, err
+	}
+	min, max := c.MinSequence, c.MaxSequence
+	if min == 0 {
+		min = otpMinSequence
+	}
+	if max == 0 {
+		max = otpMaxSequence
+	}
+	if sequence < min || sequence > max {
+		return nil, errors.New("OTP sequence number out of range")
+	}
+	_, passphrase, _ := m.Credentials()
+	key := otpKey(algorithm, seed, passphrase, sequence)
+
+	if c.Reinit == nil {
+		if c.SixWord {
+			return append([]byte("word:"), otpEncodeWords(key)...), nil
+		}
+		return append([]byte("hex:"), hex.EncodeToString(key[:])...), nil
+	}
+
+	if !ext {
+		return nil, errors.New("Server does not support reinitializing the sequence")
+	}
+	reinit := c.Reinit
+	if !validOTPSeed(reinit.Seed) || reinit.Sequence < 1 {
+		return nil, errors.New("Invalid OTP sequence or seed")
+	}
+	if reinit.Passphrase != nil {
+		passphrase = reinit.Passphrase
+	}
+	newKey := otpKey(algorithm, reinit.Seed, passphrase, reinit.Sequence)
+	encode := func(k [8]byte) string {
+		return hex.EncodeToString(k[:])
+	}
+	resp := []byte("init-hex:")
+	if c.SixWord {
+		encode = otpEncodeWords
+		resp = []byte("init-word:")
+	}
+	resp = append(resp, encode(key)...)
+	resp = append(resp, ':')
+	resp = append(resp, algorithm...)
+	resp = append(resp, ' ')
+	resp = strconv.AppendInt(resp, int64(reinit.Sequence), 10)
+	resp = append(resp, ' ')
+	resp = append(resp, reinit.Seed...)
+	resp = append(resp, ':')
+	resp = append(resp, encode(newKey)...)
+	return resp, nil
+}
+
+func otpServerNext(c OTPConfig, m *Negotiator, challenge []byte, data interface{}) (more bool, resp []byte, cache interface{}, err error) {
+	switch m.State() & StepMask {
+	case AuthTextSent:
+		idx := bytes.IndexByte(challenge, 0)
+		if idx < 0 || idx == len(challenge)-1 {
+			return false, nil, nil, ErrInvalidChallenge
+		}
+		identity, username := challenge[:idx], challenge[idx+1:]
+
+		if c.Store == nil {
+			return false, nil, nil, ErrAuthn
+		}
+		state, err := c.Store.Lookup(m, username)
+		if err != nil {
+			return false, nil, nil, err
+		}
+		// Users that do not exist (or can not log in) are sent a made up
+		// challenge that is the same every time, and fail once they respond, so
+		// that they can not be told apart from users that do exist.
+		mock := state == nil || state.Sequence < 0 || otpHash(state.Algorithm) == nil
+		if mock {
+			state = otpMockState(username)
+		}
+
+		resp = append(resp, "otp-"...)
+		resp = append(resp, state.Algorithm...)
+		resp = append(resp, ' ')
+		resp = strconv.AppendInt(resp, int64(state.Sequence), 10)
+		resp = append(resp, ' ')
+		resp = append(resp, state.Seed...)
+		resp = append(resp, " ext"...)
+		return true, resp, &otpServerState{
+			username: username,
+			identity: identity,
+			state:    *state,
+			mock:     mock,
+		}, nil
+	case ResponseSent:
+		s, ok := data.(*otpServerState)
+		if !ok {
+			return false, nil, nil, ErrInvalidState
+		}
+		if s.mock {
+			return false, nil, nil, ErrAuthn
+		}
+		newState, err := otpVerify(s.state, challenge)
+		if err != nil {
+			return false, nil, nil, err
+		}
+		if err = c.Store.Update(m, s.username, newState); err != nil {
+			return false, nil, nil, err
+		}
+		if !m.Permissions(Credentials(func() (Username, Password, Identity []byte) {
+			return s.username, nil, s.identity
+		})) {
+			return false, nil, nil, ErrAuthn
+		}
+		return false, nil, nil, nil
+	}
+	return false, nil, nil, ErrTooManySteps
+}
+
+// otpMockState returns the state used to build the challenge sent to a user
+// that does not exist.
+func otpMockState(username []byte) *OTPState {
+	h := hmac.New(sha256.New, otpMockKey)
+	h.Write(username)
+	sum := h.Sum(nil)
+
+	// Seeds are usually two letters followed by four digits.
+	seed := []byte{'a' + sum[0]%26, 'a' + sum[1]%26}
+	seed = strconv.AppendInt(seed, 1000+int64(binary.BigEndian.Uint16(sum[2:]))%9000, 10)
+	return &OTPState{
+		Algorithm: "sha1",
+		Sequence:  50 + int(binary.BigEndian.Uint16(sum[4:]))%450,
+		Seed:      string(seed),
+	}
+}
+
+// otpVerify checks the clients response against the stored state and returns
+// the state that should be stored if it is valid.
+func otpVerify(state OTPState, resp []byte) (OTPState, error) {
+	idx := bytes.IndexByte(resp, ':')
+	if idx < 0 {
+		return state, ErrInvalidChallenge
+	}
+	typ, value := string(bytes.ToLower(resp[:idx])), string(resp[idx+1:])
+
+	var decode func(string) ([8]byte, error)
+	switch strings.TrimPrefix(typ, "init-") {
+	case "hex":
+		decode = otpDecodeHex
+	case "word":
+		decode = otpDecodeWords
+	default:
+		return state, ErrInvalidChallenge
+	}
+
+	var newParams, newValue string
+	if strings.HasPrefix(typ, "init-") {
+		parts := strings.Split(value, ":")
+		if len(parts) != 3 {
+			return state, ErrInvalidChallenge
+		}
+		value, newParams, newValue = parts[0], parts[1], parts[2]
+	}
+
+	key, err := decode(value)
+	if err != nil {
+		return state, err
+	}
+	if otpHash(state.Algorithm)(key[:]) != state.Key {
+		return state, ErrAuthn
+	}
+
+	if newParams == "" {
+		state.Key = key
+		state.Sequence--
+		return state, nil
+	}
+
+	algorithm, sequence, seed, _, err := parseOTPChallenge([]byte("otp-" + newParams))
+	if err != nil {
+		return state, err
+	}
+	newKey, err := decode(newValue)
+	if err != nil {
+		return state, err
+	}
+	return OTPState{
+		Algorithm: algorithm,
+		Sequence:  sequence - 1,
+		Seed:      seed,
+		Key:       newKey,
+	}, nil
+}
+
+// parseOTPChallenge parses an OTP challenge of the form
+// "otp-<algorithm> <sequence> <seed>" optionally followed by "ext" and other
+// extensions.
+func parseOTPChallenge(challenge []byte) (algorithm string, sequence int, seed string, ext bool, err error) {
+	fields := strings.Fields(string(challenge))
+	if len(fields) < 3 || !strings.HasPrefix(fields[0], "otp-") {
+		return "", 0, "", false, ErrInvalidChallenge
+	}
+	algorithm = strings.ToLower(strings.TrimPrefix(fields[0], "otp-"))
+	if otpHash(algorithm) == nil {
+		return "", 0, "", false, errors.New("Unsupported OTP algorithm")
+	}
+	sequence, err = strconv.Atoi(fields[1])
+	if err != nil || sequence < 0 {
+		return "", 0, "", false, ErrInvalidChallenge
+	}
+	seed = fields[2]
+	if !validOTPSeed(seed) {
+		return "", 0, "", false, ErrInvalidChallenge
+	}
+	for _, f := range fields[3:] {
+		for _, e := range strings.Split(f, ",") {
+			if e == "ext" {
+				ext = true
+			}
+		}
+	}
+	return algorithm, sequence, seed, ext, nil
+}
+
+func validOTPSeed(seed string) bool {
+	if len(seed) < 1 || len(seed) > 16 {
+		return false
+	}
+	for _, c := range seed {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// otpHash returns a function that hashes its input and folds the result to 64 bits as
+// defined in RFC 2289, or nil if the algorithm is not supported.
+func otpHash(algorithm string) func(b []byte) [8]byte {
+	switch algorithm {
+	case "md5":
+		return func(p []byte) (out [8]byte) {
+			sum := md5.Sum(p)
+			for i := range out {
+				out[i] = sum[i] ^ sum[i+8]
+			}
+			return out
+		}
+	case "sha1":
+		return func(p []byte) (out [8]byte) {
+			sum := sha1.Sum(p)
+			// The folded words are stored in little endian order by the reference
+			// implementation and the RFC test vectors depend on it.
+			a := binary.BigEndian.Uint32(sum[0:]) ^ binary.BigEndian.Uint32(sum[8:]) ^ binary.BigEndian.Uint32(sum[16:])
+			b := binary.BigEndian.Uint32(sum[4:]) ^ binary.BigEndian.Uint32(sum[12:])
+			binary.LittleEndian.PutUint32(out[0:], a)
+			binary.LittleEndian.PutUint32(out[4:], b)
+			return out
+		}
+	}
+	return nil
+}
+
+// otpKey computes the one-time password with the given sequence number.
+func otpKey(algorithm, seed string, passphrase []byte, sequence int) [8]byte {
+	h := otpHash(algorithm)
+	key := h(append([]byte(strings.ToLower(seed)), passphrase...))
+	for i := 0; i < sequence; i++ {
+		key = h(key[:])
+	}
+	return key
+}
+
+func otpDecodeHex(s string) (key [8]byte, err error) {
+	s = strings.Join(strings.Fields(s), "")
+	if hex.DecodedLen(len(s)) != len(key) {
+		return key, ErrInvalidChallenge
+	}
+	_, err = hex.Decode(key[:], []byte(s))
+	if err != nil {
+		return key, ErrInvalidChallenge
+	}
+	return key, nil
+}
+
+// otpEncodeWords encodes key as six words from the RFC 2289 dictionary.
+// The last two bits of the 66 bits encoded are a checksum.
+func otpEncodeWords(key [8]byte) string {
+	bits := binary.BigEndian.Uint64(key[:])
+	words := make([]string, 6)
+	for i := range words {
+		words[i] = otpWords[otpWordIndex(bits, otpParity(bits), i)]
+	}
+	return strings.Join(words, " ")
+}
+
+// otpWordIndex returns the i'th 11 bit group of the 66 bit number made up of
+// bits followed by the 2 bit parity.
+func otpWordIndex(bits uint64, parity uint64, i int) uint64 {
+	if i < 5 {
+		return bits >> uint(53-11*i) & 0x7ff
+	}
+	return (bits&0x1ff)<<2 | parity
+}
+
+func otpParity(bits uint64) uint64 {
+	var parity uint64
+	for i := uint(0); i < 64; i += 2 {
+		parity += bits >> i & 3
+	}
+	return parity & 3
+}
+
+func otpDecodeWords(s string) (key [8]byte, err error) {
+	words := strings.Fields(strings.ToUpper(s))
+	if len(words) != 6 {
+		return key, ErrInvalidChallenge
+	}
+	var bits, parity uint64
+	for i, w := range words {
+		idx, ok := otpWordLookup(w)
+		if !ok {
+			return key, ErrInvalidChallenge
+		}
+		if i < 5 {
+			bits = bits<<11 | idx
+			continue
+		}
+		bits = bits<<9 | idx>>2
+		parity = idx & 3
+	}
+	if otpParity(bits) != parity {
+		return key, ErrInvalidChallenge
+	}
+	binary.BigEndian.PutUint64(key[:], bits)
+	return key, nil
+}
+
+// otpWordLookup finds the index of word in the dictionary.
+// The dictionary contains the words of up to three letters in alphabetical
+// order followed by the four letter words in alphabetical order.
+func otpWordLookup(word string) (uint64, bool) {
+	short := len(word) < 4
+	lo, hi := 0, len(otpWords)
+	for lo < hi {
+		mid := (lo + hi) / 2
+		w := otpWords[mid]
+		if wShort := len(w) < 4; wShort && !short || wShort == short && w < word {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo < len(otpWords) && otpWords[lo] == word {
+		return uint64(lo), true
+	}
+	return 0, false
+}
@@ -0,0 +1,288 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// RFC 2289 appendix C.
+var otpTestCases = [...]struct {
+	algorithm  string
+	passphrase string
+	seed       string
+	sequence   int
+	hex        string
+	words      string
+}{
+	{"md5", "This is a test.", "TeSt", 0, "9e876134d90499dd", "INCH SEA ANNE LONG AHEM TOUR"},
+	{"md5", "This is a test.", "TeSt", 1, "7965e05436f5029f", "EASE OIL FUM CURE AWRY AVIS"},
+	{"md5", "This is a test.", "TeSt", 99, "50fe1962c4965880", "BAIL TUFT BITS GANG CHEF THY"},
+	{"md5", "AbCdEfGhIjK", "alpha1", 0, "87066dd9644bf206", "FULL PEW DOWN ONCE MORT ARC"},
+	{"md5", "AbCdEfGhIjK", "alpha1", 1, "7cd34c1040add14b", "FACT HOOF AT FIST SITE KENT"},
+	{"md5", "AbCdEfGhIjK", "alpha1", 99, "5aa37a81f212146c", "BODE HOP JAKE STOW JUT RAP"},
+	{"md5", "OTP's are good", "correct", 0, "f205753943de4cf9", "ULAN NEW ARMY FUSE SUIT EYED"},
+	{"md5", "OTP's are good", "correct", 1, "ddcdac956f234937", "SKIM CULT LOB SLAM POE HOWL"},
+	{"md5", "OTP's are good", "correct", 99, "b203e28fa525be47", "LONG IVY JULY AJAR BOND LEE"},
+	{"sha1", "This is a test.", "TeSt", 0, "bb9e6ae1979d8ff4", "MILT VARY MAST OK SEES WENT"},
+	{"sha1", "This is a test.", "TeSt", 1, "63d936639734385b", "CART OTTO HIVE ODE VAT NUT"},
+	{"sha1", "This is a test.", "TeSt", 99, "87fec7768b73ccf9", "GAFF WAIT SKID GIG SKY EYED"},
+	{"sha1", "AbCdEfGhIjK", "alpha1", 0, "ad85f658ebe383c9", "LEST OR HEEL SCOT ROB SUIT"},
+	{"sha1", "AbCdEfGhIjK", "alpha1", 1, "d07ce229b5cf119b", "RITE TAKE GELD COST TUNE RECK"},
+	{"sha1", "AbCdEfGhIjK", "alpha1", 99, "27bc71035aaf3dc6", "MAY STAR TIN LYON VEDA STAN"},
+	{"sha1", "OTP's are good", "correct", 0, "d51f3e99bf8e6f0b", "RUST WELT KICK FELL TAIL FRAU"},
+	{"sha1", "OTP's are good", "correct", 1, "82aeb52d943774e4", "FLIT DOSE ALSO MEW DRUM DEFY"},
+	{"sha1", "OTP's are good", "correct", 99, "4f296a74fe1567ec", "AURA ALOE HURL WING BERG WAIT"},
+}
+
+func TestOTPKey(t *testing.T) {
+	for i, tc := range otpTestCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			key := otpKey(tc.algorithm, tc.seed, []byte(tc.passphrase), tc.sequence)
+			if h := hex.EncodeToString(key[:]); h != tc.hex {
+				t.Errorf("Unexpected key: want=%s, got=%s", tc.hex, h)
+			}
+			if words := otpEncodeWords(key); words != tc.words {
+				t.Errorf("Unexpected words: want=%q, got=%q", tc.words, words)
+			}
+			decoded, err := otpDecodeWords(strings.ToLower(tc.words))
+			if err != nil {
+				t.Fatalf("Error decoding words: %v", err)
+			}
+			if decoded != key {
+				t.Errorf("Words decoded to wrong key: want=%x, got=%x", key, decoded)
+			}
+		})
+	}
+}
+
+func TestOTPWords(t *testing.T) {
+	if len(otpWords[0]) != 1 || otpWords[570] != "YOU" || otpWords[571] != "ABED" || otpWords[2047] != "YOKE" {
+		t.Errorf("Dictionary is not in the expected order")
+	}
+	for i, w := range otpWords {
+		idx, ok := otpWordLookup(w)
+		if !ok || int(idx) != i {
+			t.Errorf("Lookup of %q returned %d, %v; want %d", w, idx, ok, i)
+		}
+	}
+	for _, words := range []string{
+		// Bad checksum.
+		"INCH SEA ANNE LONG AHEM TOOK",
+		// Not in the dictionary.
+		"INCH SEA ANNE LONG AHEM ZZZZ",
+		// Too few words.
+		"INCH SEA ANNE LONG AHEM",
+	} {
+		if _, err := otpDecodeWords(words); err == nil {
+			t.Errorf("Expected error decoding %q", words)
+		}
+	}
+}
+
+// memOTPStore is an OTPStore for a single user.
+type memOTPStore struct {
+	user  string
+	state OTPState
+}
+
+func (s *memOTPStore) Lookup(_ *Negotiator, username []byte) (*OTPState, error) {
+	if string(username) != s.user {
+		return nil, nil
+	}
+	state := s.state
+	return &state, nil
+}
+
+func (s *memOTPStore) Update(_ *Negotiator, _ []byte, state OTPState) error {
+	s.state = state
+	return nil
+}
+
+func newOTPStore(algorithm string) *memOTPStore {
+	return &memOTPStore{
+		user: "user",
+		state: OTPState{
+			Algorithm: algorithm,
+			Sequence:  99,
+			Seed:      "ke1234",
+			Key:       otpKey(algorithm, "ke1234", []byte("This is a test."), 100),
+		},
+	}
+}
+
+func otpClient(passphrase string, c OTPConfig) *Negotiator {
+	return NewClient(OTP(c), Credentials(func() ([]byte, []byte, []byte) {
+		return []byte("user"), []byte(passphrase), nil
+	}))
+}
+
+func TestOTP(t *testing.T) {
+	for _, tc := range [...]struct {
+		name       string
+		algorithm  string
+		passphrase string
+		config     OTPConfig
+		serverErr  error
+	}{
+		{name: "MD5/Hex", algorithm: "md5", passphrase: "This is a test."},
+		{name: "SHA1/Hex", algorithm: "sha1", passphrase: "This is a test."},
+		{name: "MD5/Words", algorithm: "md5", passphrase: "This is a test.", config: OTPConfig{SixWord: true}},
+		{name: "SHA1/Words", algorithm: "sha1", passphrase: "This is a test.", config: OTPConfig{SixWord: true}},
+		{name: "WrongPassphrase", algorithm: "md5", passphrase: "wrong", serverErr: ErrAuthn},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			store := newOTPStore(tc.algorithm)
+			server := NewServer(OTP(OTPConfig{Store: store}), acceptAll)
+			_, serverErr := stepPair(otpClient(tc.passphrase, tc.config), server)
+			if serverErr != tc.serverErr {
+				t.Fatalf("Unexpected server error: want=%v, got=%v", tc.serverErr, serverErr)
+			}
+			if tc.serverErr != nil {
+				if store.state.Sequence != 99 {
+					t.Errorf("Sequence changed after a failed negotiation")
+				}
+				return
+			}
+			if store.state.Sequence != 98 {
+				t.Errorf("Unexpected sequence: want=98, got=%d", store.state.Sequence)
+			}
+			if want := otpKey(tc.algorithm, "ke1234", []byte(tc.passphrase), 99); store.state.Key != want {
+				t.Errorf("Unexpected stored key: want=%x, got=%x", want, store.state.Key)
+			}
+		})
+	}
+}
+
+func TestOTPReplay(t *testing.T) {
+	store := newOTPStore("md5")
+	client := otpClient("This is a test.", OTPConfig{})
+	server := NewServer(OTP(OTPConfig{Store: store}), acceptAll)
+
+	_, resp, err := client.Step(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, challenge, err := server.Step(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(challenge) != "otp-md5 99 ke1234 ext" {
+		t.Errorf("Unexpected challenge: %q", challenge)
+	}
+	_, otpResp, err := client.Step(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = server.Step(otpResp); err != nil {
+		t.Fatal(err)
+	}
+
+	// Sending the same password again must fail.
+	server.Reset()
+	if _, _, err = server.Step(resp); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = server.Step(otpResp); err != ErrAuthn {
+		t.Errorf("Unexpected error replaying password: want=%v, got=%v", ErrAuthn, err)
+	}
+}
+
+func TestOTPReinit(t *testing.T) {
+	for _, format := range []struct {
+		name    string
+		sixWord bool
+	}{
+		{name: "Hex"},
+		{name: "Words", sixWord: true},
+	} {
+		t.Run(format.name, func(t *testing.T) {
+			store := newOTPStore("sha1")
+			server := OTP(OTPConfig{Store: store})
+			client := OTPConfig{SixWord: format.sixWord}
+			reinit := client
+			reinit.Reinit = &OTPReinit{Sequence: 500, Seed: "new123", Passphrase: []byte("A new pass phrase")}
+			_, serverErr := stepPair(otpClient("This is a test.", reinit), NewServer(server, acceptAll))
+			if serverErr != nil {
+				t.Fatalf("Unexpected error reinitializing: %v", serverErr)
+			}
+			want := OTPState{
+				Algorithm: "sha1",
+				Sequence:  499,
+				Seed:      "new123",
+				Key:       otpKey("sha1", "new123", []byte("A new pass phrase"), 500),
+			}
+			if store.state != want {
+				t.Fatalf("Unexpected state: want=%+v, got=%+v", want, store.state)
+			}
+
+			// The old pass phrase no longer works but the new one does.
+			_, serverErr = stepPair(otpClient("This is a test.", client), NewServer(server, acceptAll))
+			if serverErr != ErrAuthn {
+				t.Errorf("Unexpected error using old pass phrase: want=%v, got=%v", ErrAuthn, serverErr)
+			}
+			_, serverErr = stepPair(otpClient("A new pass phrase", client), NewServer(server, acceptAll))
+			if serverErr != nil {
+				t.Errorf("Unexpected error using new pass phrase: %v", serverErr)
+			}
+		})
+	}
+}
+
+func TestOTPUnknownUser(t *testing.T) {
+	store := newOTPStore("md5")
+	store.user = "someone"
+	_, serverErr := stepPair(otpClient("This is a test.", OTPConfig{}), NewServer(OTP(OTPConfig{Store: store}), acceptAll))
+	if serverErr != ErrAuthn {
+		t.Errorf("Unexpected error: want=%v, got=%v", ErrAuthn, serverErr)
+	}
+
+	// Users that do not exist are sent a valid challenge that does not change
+	// between attempts so that they can not be told apart from users that do.
+	challenge := func() string {
+		server := NewServer(OTP(OTPConfig{Store: store}), acceptAll)
+		_, challenge, err := server.Step([]byte("\x00user"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(challenge)
+	}
+	a, b := challenge(), challenge()
+	if _, _, _, _, err := parseOTPChallenge([]byte(a)); err != nil || a != b {
+		t.Errorf("Unexpected challenges for an unknown user: %q, %q", a, b)
+	}
+}
+
+func TestOTPSequenceRange(t *testing.T) {
+	for _, tc := range [...]struct {
+		challenge string
+		config    OTPConfig
+		err       bool
+	}{
+		{challenge: "otp-md5 99 TeSt ext"},
+		{challenge: "otp-md5 10 TeSt ext"},
+		{challenge: "otp-md5 9 TeSt ext", err: true},
+		// An attacker that learns this password can compute every later one.
+		{challenge: "otp-md5 1 TeSt ext", err: true},
+		{challenge: "otp-md5 1 TeSt ext", config: OTPConfig{MinSequence: 1}},
+		{challenge: "otp-md5 0 TeSt ext", config: OTPConfig{MinSequence: -1}},
+		{challenge: "otp-md5 10000 TeSt ext", err: true},
+		{challenge: "otp-md5 2147483647 TeSt ext", err: true},
+		{challenge: "otp-md5 99 TeSt ext", config: OTPConfig{MaxSequence: 50}, err: true},
+	} {
+		t.Run(tc.challenge, func(t *testing.T) {
+			client := otpClient("This is a test.", tc.config)
+			if _, _, err := client.Step(nil); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := client.Step([]byte(tc.challenge)); (err != nil) != tc.err {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,365 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+)
+
+// The length of the challenge sent by PASSKEY servers.
+const passkeyChallengeLen = 32
+
+// passkeyMockKey is used to derive the credential ID sent to clients that try
+// to log in as users that do not exist.
+var passkeyMockKey = nonce(32, rand.Reader)
+
+// Authenticator data flags defined by WebAuthn.
+const (
+	passkeyUserPresent  = 0x01
+	passkeyUserVerified = 0x04
+)
+
+// A PasskeyCredential is a WebAuthn public key credential registered for a
+// user.
+type PasskeyCredential struct {
+	// ID is the credential ID.
+	ID []byte
+
+	// PublicKey is the credentials public key.
+	// Only ES256 (ECDSA using the NIST P-256 curve and SHA-256) is supported.
+	PublicKey *ecdsa.PublicKey
+
+	// SignCount is the last signature counter reported by the authenticator.
+	SignCount uint32
+}
+
+// A PasskeyStore is used by PASSKEY servers to look up the credentials
+// registered for a user and to store their signature counters.
+type PasskeyStore interface {
+	// Credentials returns the credentials registered for the user.
+	// If the user does not exist it should return no credentials and a nil
+	// error.
+	Credentials(n *Negotiator, username []byte) ([]PasskeyCredential, error)
+
+	// UpdateSignCount stores the new signature counter of a credential after
+	// it has been used to authenticate.
+	UpdateSignCount(n *Negotiator, username, id []byte, signCount uint32) error
+}
+
+// PasskeyConfig configures the PASSKEY mechanism.
+// Clients only use Authenticator, and servers, which act as a WebAuthn relying
+// party, use the other fields.
+type PasskeyConfig struct {
+	// Authenticator is used by clients to get an assertion from an
+	// authenticator, for example a platform authenticator or a security key
+	// using CTAP.
+	// It is called with the relying party ID sent by the server, the hash of
+	// the client data to sign, and the IDs of the credentials that the server
+	// will accept (which may be empty).
+	// Because the relying party ID comes from the server, it should make sure
+	// that it is one that the server is allowed to use.
+	Authenticator func(n *Negotiator, rpID string, clientDataHash []byte, allowCredentials [][]byte) (PasskeyAssertion, error)
+
+	// RPID is the relying party identifier that the credentials were registered
+	// with, usually the domain name of the service.
+	RPID string
+
+	// Store is used to look up the credentials of users.
+	Store PasskeyStore
+
+	// UserVerification requires the authenticator to verify the user (for
+	// example with a PIN or biometrics) and not just test for their presence.
+	UserVerification bool
+}
+
+// A PasskeyAssertion is the result of a WebAuthn authentication ceremony
+// performed by an authenticator.
+type PasskeyAssertion struct {
+	CredentialID      []byte
+	AuthenticatorData []byte
+	Signature         []byte
+	UserHandle        []byte
+}
+
+type passkeyDescriptor struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// passkeyRequest is the subset of the WebAuthn
+// PublicKeyCredentialRequestOptions dictionary sent as the server challenge.
+type passkeyRequest struct {
+	Challenge        string              `json:"challenge"`
+	RPID             string              `json:"rpId"`
+	AllowCredentials []passkeyDescriptor `json:"allowCredentials,omitempty"`
+	UserVerification string              `json:"userVerification,omitempty"`
+}
+
+type passkeyResponse struct {
+	ID                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+	UserHandle        string `json:"userHandle,omitempty"`
+}
+
+type passkeyClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+// passkeyServerState is cached by servers between the challenge and response.
+type passkeyServerState struct {
+	username    []byte
+	identity    []byte
+	challenge   string
+	credentials []PasskeyCredential
+}
+
+func passkey(c PasskeyConfig) Mechanism {
+	return Mechanism{
+		Name:       "PASSKEY",
+		Properties: NoPlaintext | NoDictionary,
+		Start: func(m *Negotiator) (more bool, resp []byte, cache interface{}, err error) {
+			username, _, identity := m.Credentials()
+			if len(username) == 0 {
+				return false, nil, nil, errors.New("A username is required")
+			}
+			resp = append(resp, identity...)
+			resp = append(resp, 0)
+			resp = append(resp, username...)
+			return true, resp, nil, nil
+		},
+		Next: func(m *Negotiator, challenge []byte, data interface{}) (more bool, resp []byte, cache interface{}, err error) {
+			if m.State()&Receiving == Receiving {
+				return passkeyServerNext(c, m, challenge, data)
+			}
+
+			switch m.State() & StepMask {
+			case AuthTextSent:
+				var req passkeyRequest
+				if err = json.Unmarshal(challenge, &req); err != nil || req.RPID == "" {
+					return false, nil, nil, ErrInvalidChallenge
+				}
+				if b, err := base64.RawURLEncoding.DecodeString(req.Challenge); err != nil || len(b) < 16 {
+					return false, nil, nil, ErrInvalidChallenge
+				}
+				var allow [][]byte
+				for _, desc := range req.AllowCredentials {
+					id, err := base64.RawURLEncoding.DecodeString(desc.ID)
+					if err != nil {
+						return false, nil, nil, ErrInvalidChallenge
+					}
+					allow = append(allow, id)
+				}
+
+				clientData, err := json.Marshal(passkeyClientData{
+					Type:      "webauthn.get",
+					Challenge: req.Challenge,
+					Origin:    passkeyOrigin(req.RPID),
+				})
+				if err != nil {
+					return false, nil, nil, err
+				}
+				if c.Authenticator == nil {
+					return false, nil, nil, errors.New("An authenticator is required")
+				}
+				clientDataHash := sha256.Sum256(clientData)
+				assertion, err := c.Authenticator(m, req.RPID, clientDataHash[:], allow)
+				if err != nil {
+					return false, nil, nil, err
+				}
+
+				resp, err = json.Marshal(passkeyResponse{
+					ID:                base64.RawURLEncoding.EncodeToString(assertion.CredentialID),
+					ClientDataJSON:    base64.RawURLEncoding.EncodeToString(clientData),
+					AuthenticatorData: base64.RawURLEncoding.EncodeToString(assertion.AuthenticatorData),
+					Signature:         base64.RawURLEncoding.EncodeToString(assertion.Signature),
+					UserHandle:        base64.RawURLEncoding.EncodeToString(assertion.UserHandle),
+				})
+				return err == nil, resp, nil, err
+			case ResponseSent:
+				// The server does not send any additional data with success.
+				if len(challenge) > 0 {
+					return false, nil, nil, ErrInvalidChallenge
+				}
+				return false, nil, nil, nil
+			}
+			return false, nil, nil, ErrTooManySteps
+		},
+	}
+}
+
+// passkeyMockID returns the credential ID sent to clients that try to log in as
+// a user without any credentials.
+func passkeyMockID(rpID string, username []byte) []byte {
+	h := hmac.New(sha256.New, passkeyMockKey)
+	h.Write([]byte(rpID))
+	h.Write([]byte{0})
+	h.Write(username)
+	return h.Sum(nil)[:16]
+}
+
+// passkeyOrigin returns the origin used in the client data, which is not
+// otherwise known outside of a web browser.
+func passkeyOrigin(rpID string) string {
+	return "https://" + rpID
+}
+
+func passkeyServerNext(c PasskeyConfig, m *Negotiator, challenge []byte, data interface{}) (more bool, resp []byte, cache interface{}, err error) {
+	if c.Store == nil || c.RPID == "" {
+		return false, nil, nil, ErrAuthn
+	}
+
+	switch m.State() & StepMask {
+	case AuthTextSent:
+		// The client sends the authorization identity, a NUL byte, and the
+		// username.
+		idx := bytes.IndexByte(challenge, 0)
+		if idx < 0 || idx == len(challenge)-1 {
+			return false, nil, nil, ErrInvalidChallenge
+		}
+		identity, username := challenge[:idx], challenge[idx+1:]
+
+		creds, err := c.Store.Credentials(m, username)
+		if err != nil {
+			return false, nil, nil, err
+		}
+		b := make([]byte, passkeyChallengeLen)
+		if _, err = rand.Read(b); err != nil {
+			return false, nil, nil, err
+		}
+		req := passkeyRequest{
+			Challenge:        base64.RawURLEncoding.EncodeToString(b),
+			RPID:             c.RPID,
+			UserVerification: "preferred",
+		}
+		if c.UserVerification {
+			req.UserVerification = "required"
+		}
+		ids := make([][]byte, 0, len(creds))
+		for _, cred := range creds {
+			ids = append(ids, cred.ID)
+		}
+		// Users that do not exist (or have no credentials) are sent a made up
+		// credential ID that is the same every time so that an empty list does
+		// not give them away.
+		if len(ids) == 0 {
+			ids = append(ids, passkeyMockID(c.RPID, username))
+		}
+		for _, id := range ids {
+			req.AllowCredentials = append(req.AllowCredentials, passkeyDescriptor{
+				Type: "public-key",
+				ID:   base64.RawURLEncoding.EncodeToString(id),
+			})
+		}
+		resp, err = json.Marshal(req)
+		if err != nil {
+			return false, nil, nil, err
+		}
+		return true, resp, &passkeyServerState{
+			username:    username,
+			identity:    identity,
+			challenge:   req.Challenge,
+			credentials: creds,
+		}, nil
+	case ResponseSent:
+		state, ok := data.(*passkeyServerState)
+		if !ok {
+			return false, nil, nil, ErrInvalidState
+		}
+		var pr passkeyResponse
+		if err = json.Unmarshal(challenge, &pr); err != nil {
+			return false, nil, nil, ErrInvalidChallenge
+		}
+		id, err := base64.RawURLEncoding.DecodeString(pr.ID)
+		if err != nil {
+			return false, nil, nil, ErrInvalidChallenge
+		}
+		clientData, err := base64.RawURLEncoding.DecodeString(pr.ClientDataJSON)
+		if err != nil {
+			return false, nil, nil, ErrInvalidChallenge
+		}
+		authData, err := base64.RawURLEncoding.DecodeString(pr.AuthenticatorData)
+		if err != nil || len(authData) < 37 {
+			return false, nil, nil, ErrInvalidChallenge
+		}
+		sigBytes, err := base64.RawURLEncoding.DecodeString(pr.Signature)
+		if err != nil {
+			return false, nil, nil, ErrInvalidChallenge
+		}
+
+		var cred *PasskeyCredential
+		for i := range state.credentials {
+			if bytes.Equal(state.credentials[i].ID, id) {
+				cred = &state.credentials[i]
+				break
+			}
+		}
+		if cred == nil || cred.PublicKey == nil || cred.PublicKey.Curve != elliptic.P256() {
+			return false, nil, nil, ErrAuthn
+		}
+
+		var cd passkeyClientData
+		if err = json.Unmarshal(clientData, &cd); err != nil {
+			return false, nil, nil, ErrInvalidChallenge
+		}
+		if cd.Type != "webauthn.get" || cd.Challenge != state.challenge || cd.Origin != passkeyOrigin(c.RPID) {
+			return false, nil, nil, ErrAuthn
+		}
+
+		// The authenticator data starts with the SHA-256 hash of the relying
+		// party ID, a byte of flags, and the signature counter.
+		rpIDHash := sha256.Sum256([]byte(c.RPID))
+		if !bytes.Equal(authData[:32], rpIDHash[:]) {
+			return false, nil, nil, ErrAuthn
+		}
+		flags := authData[32]
+		if flags&passkeyUserPresent == 0 || (c.UserVerification && flags&passkeyUserVerified == 0) {
+			return false, nil, nil, ErrAuthn
+		}
+
+		var sig ecdsaSignature
+		rest, err := asn1.Unmarshal(sigBytes, &sig)
+		if err != nil || len(rest) > 0 || sig.R == nil || sig.S == nil {
+			return false, nil, nil, ErrInvalidChallenge
+		}
+		clientDataHash := sha256.Sum256(clientData)
+		signed := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+		if !ecdsa.Verify(cred.PublicKey, signed[:], sig.R, sig.S) {
+			return false, nil, nil, ErrAuthn
+		}
+
+		// A counter that does not increase may mean that the authenticator has
+		// been cloned.
+		// Authenticators that do not implement a counter always report zero.
+		signCount := binary.BigEndian.Uint32(authData[33:37])
+		if (signCount != 0 || cred.SignCount != 0) && signCount <= cred.SignCount {
+			return false, nil, nil, ErrAuthn
+		}
+		if err = c.Store.UpdateSignCount(m, state.username, cred.ID, signCount); err != nil {
+			return false, nil, nil, err
+		}
+
+		if !m.Permissions(Credentials(func() (Username, Password, Identity []byte) {
+			return state.username, nil, state.identity
+		})) {
+			return false, nil, nil, ErrAuthn
+		}
+		return false, nil, nil, nil
+	}
+	return false, nil, nil, ErrTooManySteps
+}
@@ -0,0 +1,266 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+const testRPID = "example.com"
+
+// softAuthenticator is a stand-in for a WebAuthn authenticator that holds a
+// single ES256 credential in memory.
+type softAuthenticator struct {
+	id        []byte
+	key       *ecdsa.PrivateKey
+	signCount uint32
+	flags     byte
+	rpID      string
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 16)
+	if _, err = rand.Read(id); err != nil {
+		t.Fatal(err)
+	}
+	return &softAuthenticator{id: id, key: key, flags: passkeyUserPresent | passkeyUserVerified}
+}
+
+func (a *softAuthenticator) getAssertion(_ *Negotiator, rpID string, clientDataHash []byte, allow [][]byte) (PasskeyAssertion, error) {
+	found := false
+	for _, id := range allow {
+		found = found || bytes.Equal(id, a.id)
+	}
+	if !found {
+		return PasskeyAssertion{}, errors.New("no credential")
+	}
+	// Pretend to be a phished authenticator by signing for another relying
+	// party if one was set.
+	if a.rpID != "" {
+		rpID = a.rpID
+	}
+
+	a.signCount++
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	authData := append(rpIDHash[:], a.flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(authData[33:], a.signCount)
+
+	signed := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash...))
+	r, s, err := ecdsa.Sign(rand.Reader, a.key, signed[:])
+	if err != nil {
+		return PasskeyAssertion{}, err
+	}
+	sig, err := asn1.Marshal(ecdsaSignature{R: r, S: s})
+	if err != nil {
+		return PasskeyAssertion{}, err
+	}
+	return PasskeyAssertion{
+		CredentialID:      a.id,
+		AuthenticatorData: authData,
+		Signature:         sig,
+	}, nil
+}
+
+type memPasskeyStore map[string][]PasskeyCredential
+
+func (s memPasskeyStore) Credentials(_ *Negotiator, username []byte) ([]PasskeyCredential, error) {
+	return s[string(username)], nil
+}
+
+func (s memPasskeyStore) UpdateSignCount(_ *Negotiator, username, id []byte, signCount uint32) error {
+	for i, cred := range s[string(username)] {
+		if bytes.Equal(cred.ID, id) {
+			s[string(username)][i].SignCount = signCount
+			return nil
+		}
+	}
+	return errors.New("no such credential")
+}
+
+func TestPasskey(t *testing.T) {
+	for _, tc := range [...]struct {
+		name      string
+		user      string
+		identity  string
+		uv        bool
+		setup     func(a *softAuthenticator, store memPasskeyStore)
+		noAuth    bool
+		clientErr bool
+		serverErr error
+	}{
+		{name: "Valid", user: "juliet"},
+		{name: "Identity", user: "juliet", identity: "admin"},
+		{name: "UserVerification", user: "juliet", uv: true},
+		{
+			name: "NotVerified",
+			user: "juliet",
+			uv:   true,
+			setup: func(a *softAuthenticator, _ memPasskeyStore) {
+				a.flags = passkeyUserPresent
+			},
+			serverErr: ErrAuthn,
+		},
+		{
+			name: "NotPresent",
+			user: "juliet",
+			setup: func(a *softAuthenticator, _ memPasskeyStore) {
+				a.flags = 0
+			},
+			serverErr: ErrAuthn,
+		},
+		{
+			name: "WrongKey",
+			user: "juliet",
+			setup: func(a *softAuthenticator, _ memPasskeyStore) {
+				a.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			},
+			serverErr: ErrAuthn,
+		},
+		{
+			name: "WrongRPID",
+			user: "juliet",
+			setup: func(a *softAuthenticator, _ memPasskeyStore) {
+				a.rpID = "example.net"
+			},
+			serverErr: ErrAuthn,
+		},
+		{
+			name: "ClonedAuthenticator",
+			user: "juliet",
+			setup: func(a *softAuthenticator, store memPasskeyStore) {
+				store["juliet"][0].SignCount = 10
+				a.signCount = 5
+			},
+			serverErr: ErrAuthn,
+		},
+		{name: "UnknownUser", user: "romeo", clientErr: true},
+		{name: "NoAuthenticator", user: "juliet", noAuth: true, clientErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			auth := newSoftAuthenticator(t)
+			store := memPasskeyStore{
+				"juliet": {{ID: auth.id, PublicKey: &auth.key.PublicKey}},
+			}
+			if tc.setup != nil {
+				tc.setup(auth, store)
+			}
+
+			user, identity := tc.user, tc.identity
+			var clientConfig PasskeyConfig
+			if !tc.noAuth {
+				clientConfig.Authenticator = auth.getAssertion
+			}
+			var gotUser, gotIdentity string
+			perm := func(n *Negotiator) bool {
+				u, _, i := n.Credentials()
+				gotUser, gotIdentity = string(u), string(i)
+				return true
+			}
+			client := NewClient(Passkey(clientConfig), Credentials(func() ([]byte, []byte, []byte) {
+				return []byte(user), nil, []byte(identity)
+			}))
+			server := NewServer(Passkey(PasskeyConfig{
+				RPID:             testRPID,
+				Store:            store,
+				UserVerification: tc.uv,
+			}), perm)
+
+			clientErr, serverErr := stepPair(client, server)
+			if (clientErr != nil) != tc.clientErr {
+				t.Errorf("Unexpected client error: %v", clientErr)
+			}
+			if serverErr != tc.serverErr {
+				t.Errorf("Unexpected server error: want=%v, got=%v", tc.serverErr, serverErr)
+			}
+			if tc.clientErr || tc.serverErr != nil {
+				return
+			}
+			if gotUser != tc.user || gotIdentity != tc.identity {
+				t.Errorf("Unexpected credentials: want=%q/%q, got=%q/%q", tc.user, tc.identity, gotUser, gotIdentity)
+			}
+			if count := store["juliet"][0].SignCount; count != auth.signCount {
+				t.Errorf("Signature counter not updated: want=%d, got=%d", auth.signCount, count)
+			}
+		})
+	}
+}
+
+func TestPasskeyReplay(t *testing.T) {
+	auth := newSoftAuthenticator(t)
+	store := memPasskeyStore{
+		"juliet": {{ID: auth.id, PublicKey: &auth.key.PublicKey}},
+	}
+	client := NewClient(Passkey(PasskeyConfig{Authenticator: auth.getAssertion}), Credentials(func() ([]byte, []byte, []byte) {
+		return []byte("juliet"), nil, nil
+	}))
+	server := NewServer(Passkey(PasskeyConfig{RPID: testRPID, Store: store}), acceptAll)
+
+	_, resp, err := client.Step(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, challenge, err := server.Step(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, assertion, err := client.Step(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if more, _, err := server.Step(assertion); err != nil || more {
+		t.Fatalf("Unexpected result: more=%t, err=%v", more, err)
+	}
+
+	// The same assertion cannot be used to answer a new challenge.
+	server.Reset()
+	if _, _, err = server.Step(resp); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = server.Step(assertion); err != ErrAuthn {
+		t.Errorf("Expected a replayed assertion to fail with ErrAuthn, got %v", err)
+	}
+}
+
+func TestPasskeyUnknownUser(t *testing.T) {
+	auth := newSoftAuthenticator(t)
+	store := memPasskeyStore{
+		"juliet": {{ID: auth.id, PublicKey: &auth.key.PublicKey}},
+	}
+	allow := func(user string) []passkeyDescriptor {
+		server := NewServer(Passkey(PasskeyConfig{RPID: testRPID, Store: store}), acceptAll)
+		_, challenge, err := server.Step(append([]byte{0}, user...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var req passkeyRequest
+		if err = json.Unmarshal(challenge, &req); err != nil {
+			t.Fatal(err)
+		}
+		return req.AllowCredentials
+	}
+
+	// Users that do not exist are sent a credential ID that does not change
+	// between attempts, just like users that do.
+	a, b := allow("romeo"), allow("romeo")
+	if len(a) != 1 || len(b) != 1 || a[0] != b[0] {
+		t.Errorf("Unexpected credentials for an unknown user: %v, %v", a, b)
+	}
+	if known := allow("juliet"); len(known) != 1 || known[0] == a[0] {
+		t.Errorf("Unexpected credentials for a known user: %v", known)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"crypto/tls"
+)
+
+// defaultPreference is the order in which mechanisms are selected if a Policy
+// does not specify one, strongest first.
+var defaultPreference = []string{
+	"PASSKEY",
+	"HT-SHA-256-EXPR",
+	"HT-SHA-256-UNIQ",
+	"HT-SHA-256-ENDP",
+	"GS2-KRB5-PLUS",
+	"SCRAM-SHA-256-PLUS",
+	"SCRAM-SHA-1-PLUS",
+	"HT-SHA-256-NONE",
+	"SCRAM-SHA-256",
+	"SCRAM-SHA-1",
+	"GS2-KRB5",
+	"GSSAPI",
+	"ECDSA-NIST256P-CHALLENGE",
+	"SAML20",
+	"OPENID20",
+	"OTP",
+	"DIGEST-MD5",
+	"CRAM-MD5",
+	"PLAIN",
+}
+
+// Policy controls which mechanisms may be used and which are preferred.
+// The zero value is a reasonable default: it prefers stronger mechanisms,
+// never uses channel binding mechanisms without TLS, and never uses
+// mechanisms that reveal the password without TLS.
+// Mechanisms with unknown (zero) Properties, such as custom mechanisms, are
+// treated like PLAIN and are only used without TLS if AllowPlaintext is set.
+type Policy struct {
+	// Preference lists mechanism names in order of preference.
+	// If it is nil a default order is used.
+	// Mechanisms that do not appear in the list are less preferred than those
+	// that do and keep the order in which they were provided.
+	Preference []string
+
+	// Require is the set of properties that a mechanism must have.
+	// When TLS is in use the NoPlaintext property is not required because the
+	// channel already protects the password from passive attackers.
+	Require Property
+
+	// RequireChannelBinding only allows mechanisms that bind the authentication
+	// to the TLS channel.
+	// It is the same as adding ChannelBinding to Require.
+	RequireChannelBinding bool
+
+	// AllowPlaintext allows mechanisms that lack the NoPlaintext property, such
+	// as PLAIN, to be used without TLS.
+	AllowPlaintext bool
+}
+
+// Allowed reports whether the policy allows m to be used on a connection with
+// the given TLS state (or no TLS if it is nil).
+func (p Policy) Allowed(m Mechanism, tlsState *tls.ConnectionState) bool {
+	require := p.Require
+	if p.RequireChannelBinding {
+		require |= ChannelBinding
+	}
+	switch {
+	case tlsState != nil:
+		require &^= NoPlaintext
+	case !p.AllowPlaintext:
+		require |= NoPlaintext
+	}
+
+	if m.Properties&ChannelBinding == ChannelBinding && tlsState == nil {
+		return false
+	}
+	return m.Properties&require == require
+}
+
+// rank returns the position of name in the preference list, or -1 if it is
+// not listed.
+func (p Policy) rank(name string) int {
+	pref := p.Preference
+	if pref == nil {
+		pref = defaultPreference
+	}
+	for i, n := range pref {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// sort returns the mechanisms from ms that are allowed by the policy in order
+// of preference.
+func (p Policy) sort(ms []Mechanism, tlsState *tls.ConnectionState) []Mechanism {
+	var ranked, unranked []Mechanism
+	for _, m := range ms {
+		if !p.Allowed(m, tlsState) {
+			continue
+		}
+		if p.rank(m.Name) < 0 {
+			unranked = append(unranked, m)
+			continue
+		}
+		// Insertion sort, the lists are short.
+		i := len(ranked)
+		ranked = append(ranked, m)
+		for ; i > 0 && p.rank(ranked[i-1].Name) > p.rank(m.Name); i-- {
+			ranked[i] = ranked[i-1]
+		}
+		ranked[i] = m
+	}
+	return append(ranked, unranked...)
+}
+
+// Select picks the most preferred mechanism from local that was advertised by
+// the server in remote and is allowed by the policy, and returns a new client
+// Negotiator that uses it.
+// The options are passed to NewClient along with RemoteMechanisms(remote...),
+// and the TLS state (if any) is taken from them.
+// If no mechanism is acceptable, ErrNoMechanism is returned.
+func Select(remote []string, local []Mechanism, p Policy, opts ...Option) (*Negotiator, error) {
+	probe := &Negotiator{}
+	getOpts(probe, opts...)
+
+	for _, m := range p.sort(local, probe.TLSState()) {
+		for _, name := range remote {
+			if name == m.Name {
+				return NewClient(m, append(opts[:len(opts):len(opts)], RemoteMechanisms(remote...))...), nil
+			}
+		}
+	}
+	return nil, ErrNoMechanism
+}
+
+// Enforce causes the negotiator to fail with ErrPolicy before the first step if
+// the policy does not allow its mechanism to be used with the current TLS
+// state.
+// The preference order of the policy is ignored.
+func Enforce(p Policy) Option {
+	return func(n *Negotiator) {
+		n.policy = &p
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"crypto/tls"
+	"strconv"
+	"testing"
+)
+
+var builtinMechanisms = []Mechanism{Plain, CramMD5, ScramSha1, ScramSha1Plus, ScramSha256, ScramSha256Plus}
+
+// unknownMechanism is a custom mechanism that does not set its properties.
+var unknownMechanism = Mechanism{
+	Name: "X-UNKNOWN",
+	Start: func(*Negotiator) (bool, []byte, interface{}, error) {
+		return false, nil, nil, nil
+	},
+}
+
+var selectTestCases = [...]struct {
+	remote []string
+	local  []Mechanism
+	policy Policy
+	tls    bool
+	want   string
+	err    error
+}{
+	0: {
+		remote: []string{"PLAIN", "SCRAM-SHA-1", "SCRAM-SHA-256"},
+		local:  builtinMechanisms,
+		want:   "SCRAM-SHA-256",
+	},
+	1: {
+		remote: []string{"PLAIN", "SCRAM-SHA-1", "SCRAM-SHA-1-PLUS", "SCRAM-SHA-256"},
+		local:  builtinMechanisms,
+		tls:    true,
+		want:   "SCRAM-SHA-1-PLUS",
+	},
+	2: {
+		// -PLUS mechanisms can't be used without TLS.
+		remote: []string{"SCRAM-SHA-1-PLUS", "SCRAM-SHA-1"},
+		local:  builtinMechanisms,
+		want:   "SCRAM-SHA-1",
+	},
+	3: {
+		remote: []string{"PLAIN"},
+		local:  builtinMechanisms,
+		err:    ErrNoMechanism,
+	},
+	4: {
+		remote: []string{"PLAIN"},
+		local:  builtinMechanisms,
+		tls:    true,
+		want:   "PLAIN",
+	},
+	5: {
+		remote: []string{"PLAIN"},
+		local:  builtinMechanisms,
+		policy: Policy{AllowPlaintext: true},
+		want:   "PLAIN",
+	},
+	6: {
+		remote: []string{"PLAIN", "SCRAM-SHA-256"},
+		local:  builtinMechanisms,
+		tls:    true,
+		policy: Policy{RequireChannelBinding: true},
+		err:    ErrNoMechanism,
+	},
+	7: {
+		remote: []string{"PLAIN", "CRAM-MD5", "SCRAM-SHA-1"},
+		local:  builtinMechanisms,
+		tls:    true,
+		policy: Policy{Preference: []string{"PLAIN"}},
+		want:   "PLAIN",
+	},
+	8: {
+		// Unknown mechanisms are used if nothing better is available.
+		remote: []string{"X-CUSTOM", "CRAM-MD5"},
+		local:  append([]Mechanism{{Name: "X-CUSTOM", Properties: NoPlaintext}}, builtinMechanisms...),
+		want:   "CRAM-MD5",
+	},
+	9: {
+		remote: []string{"X-CUSTOM", "PLAIN"},
+		local:  append([]Mechanism{{Name: "X-CUSTOM", Properties: NoPlaintext}}, builtinMechanisms...),
+		want:   "X-CUSTOM",
+	},
+	10: {
+		remote: nil,
+		local:  builtinMechanisms,
+		err:    ErrNoMechanism,
+	},
+	11: {
+		// Mechanisms without properties are assumed to reveal the password.
+		remote: []string{"X-CUSTOM"},
+		local:  []Mechanism{{Name: "X-CUSTOM"}},
+		err:    ErrNoMechanism,
+	},
+	12: {
+		remote: []string{"PLAIN", "CRAM-MD5", "SCRAM-SHA-1"},
+		local:  builtinMechanisms,
+		tls:    true,
+		policy: Policy{Preference: []string{"PLAIN", "CRAM-MD5"}, Require: MutualAuth},
+		want:   "SCRAM-SHA-1",
+	},
+	13: {
+		remote: []string{"PLAIN", "CRAM-MD5"},
+		local:  builtinMechanisms,
+		tls:    true,
+		policy: Policy{Require: NoDictionary},
+		err:    ErrNoMechanism,
+	},
+}
+
+func TestEnforce(t *testing.T) {
+	for _, tc := range [...]struct {
+		name   string
+		m      Mechanism
+		policy Policy
+		tls    bool
+		err    error
+	}{
+		{name: "PLAIN without TLS", m: Plain, err: ErrPolicy},
+		{name: "PLAIN with TLS", m: Plain, tls: true},
+		{name: "PLAIN allowed", m: Plain, policy: Policy{AllowPlaintext: true}},
+		{name: "SCRAM without TLS", m: ScramSha1},
+		{name: "SCRAM-PLUS without TLS", m: ScramSha1Plus, err: ErrPolicy},
+		{name: "SCRAM requiring channel binding", m: ScramSha1, tls: true, policy: Policy{RequireChannelBinding: true}, err: ErrPolicy},
+		{name: "CRAM-MD5 requiring mutual auth", m: CramMD5, policy: Policy{Require: MutualAuth}, err: ErrPolicy},
+		{name: "Unknown properties without TLS", m: unknownMechanism, err: ErrPolicy},
+		{name: "Unknown properties with TLS", m: unknownMechanism, tls: true},
+		{name: "Unknown properties allowed", m: unknownMechanism, policy: Policy{AllowPlaintext: true}},
+		{name: "Unknown properties requiring mutual auth", m: unknownMechanism, policy: Policy{Require: MutualAuth}, err: ErrPolicy},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := []Option{Enforce(tc.policy), Credentials(func() ([]byte, []byte, []byte) {
+				return []byte("user"), []byte("pencil"), nil
+			})}
+			if tc.tls {
+				opts = append(opts, TLSState(tls.ConnectionState{TLSUnique: []byte{0, 1, 2, 3, 4}}))
+			}
+			client := NewClient(tc.m, opts...)
+			challenge := []byte(nil)
+			if tc.m.ServerFirst {
+				challenge = []byte("<1896.697170952@postoffice.reston.mci.net>")
+			}
+			_, _, err := client.Step(challenge)
+			if err != tc.err {
+				t.Fatalf("Unexpected error: want=%v, got=%v", tc.err, err)
+			}
+		})
+	}
+}
+
+func TestSelect(t *testing.T) {
+	for i, tc := range selectTestCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var opts []Option
+			if tc.tls {
+				opts = append(opts, TLSState(tls.ConnectionState{TLSUnique: []byte{0, 1, 2, 3, 4}}))
+			}
+			n, err := Select(tc.remote, tc.local, tc.policy, opts...)
+			if err != tc.err {
+				t.Fatalf("Unexpected error: want=%v, got=%v", tc.err, err)
+			}
+			if err != nil {
+				return
+			}
+			if n.mechanism.Name != tc.want {
+				t.Errorf("Wrong mechanism selected: want=%s, got=%s", tc.want, n.mechanism.Name)
+			}
+			if n.State()&Receiving == Receiving {
+				t.Errorf("Expected a client negotiator")
+			}
+			if len(n.RemoteMechanisms()) != len(tc.remote) {
+				t.Errorf("Remote mechanisms were not set on the negotiator")
+			}
+		})
+	}
+}
+
+func TestDefaultPreference(t *testing.T) {
+	var p Policy
+	plain := p.rank(Plain.Name)
+	for _, m := range []Mechanism{
+		HTSha256Expr, HTSha256Uniq, HTSha256Endp, HTSha256None,
+		OTP(OTPConfig{}),
+		EcdsaNist256pChallenge(ECDSAConfig{}),
+		SAML20(SAMLConfig{}),
+		OpenID20(OpenIDConfig{}),
+		GS2KRB5(""), GS2KRB5Plus(""),
+		Passkey(PasskeyConfig{}),
+	} {
+		if r := p.rank(m.Name); r < 0 || r > plain {
+			t.Errorf("Expected %s to be preferred over PLAIN", m.Name)
+		}
+	}
+	// A FAST token is preferred over a password when the client has one.
+	if p.rank(HTSha256Expr.Name) > p.rank(ScramSha256Plus.Name) || p.rank(HTSha256None.Name) > p.rank(ScramSha256.Name) {
+		t.Errorf("Expected HT-SHA-256 to be preferred over SCRAM")
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"bytes"
+	"errors"
+	"net/url"
+)
+
+// redirectServer is implemented by the server side of a browser based
+// mechanism.
+type redirectServer struct {
+	// redirect returns the URL that the client should visit to authenticate
+	// with the identity provider named by identifier, and any state that must
+	// be passed to verify.
+	redirect func(n *Negotiator, identifier []byte) (url string, state interface{}, err error)
+
+	// verify is called once the client reports that it has finished with the
+	// identity provider and returns the authenticated username.
+	verify func(n *Negotiator, identifier []byte, state interface{}) (username []byte, err error)
+}
+
+// redirectServerState is cached by servers between steps.
+type redirectServerState struct {
+	identifier []byte
+	identity   []byte
+	state      interface{}
+	err        error
+}
+
+// redirectMechanism returns a mechanism that follows the exchange shared by
+// SAML20 (RFC 6595) and OPENID20 (RFC 6616):
+//
+//	C: gs2-header identifier
+//	S: redirect URL
+//	   (the client authenticates using a browser)
+//	C: =
+//	S: success or failure
+//
+// If errorPrefix is not empty, servers report failures in a challenge made up
+// of the prefix and the error message, which the client must acknowledge by
+// sending "=" before the negotiation fails.
+// Browser is used by clients to visit the URL sent by the server.
+// Server is the server side of the mechanism, or nil if the server was not
+// configured for it.
+//
+// Channel binding is not supported, and because there is no -PLUS variant that
+// could have been removed from the list of mechanisms clients always send the
+// "n" channel binding flag.
+func redirectMechanism(name, errorPrefix string, browser func(n *Negotiator, url string) error, server *redirectServer) Mechanism {
+	return Mechanism{
+		Name:       name,
+		Properties: NoPlaintext | NoDictionary,
+		Start: func(m *Negotiator) (more bool, resp []byte, cache interface{}, err error) {
+			identifier, _, identity := m.Credentials()
+			if len(identifier) == 0 {
+				return false, nil, nil, errors.New("An identifier is required")
+			}
+			gs2Header := appendGS2Identity([]byte(gs2HeaderNoCBSupport), identity)
+			return true, append(gs2Header, identifier...), nil, nil
+		},
+		Next: func(m *Negotiator, challenge []byte, data interface{}) (more bool, resp []byte, cache interface{}, err error) {
+			if m.State()&Receiving == Receiving {
+				if server == nil {
+					return false, nil, nil, ErrAuthn
+				}
+				return redirectServerNext(name, errorPrefix, server, m, challenge, data)
+			}
+
+			switch m.State() & StepMask {
+			case AuthTextSent:
+				u, err := url.Parse(string(challenge))
+				if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+					return false, nil, nil, ErrInvalidChallenge
+				}
+				if browser == nil {
+					return false, nil, nil, errors.New("A browser is required to authenticate")
+				}
+				if err = browser(m, u.String()); err != nil {
+					return false, nil, nil, err
+				}
+				return true, []byte{'='}, nil, nil
+			case ResponseSent:
+				if len(challenge) == 0 {
+					return false, nil, nil, nil
+				}
+				// The server reported an error which must be acknowledged, after
+				// which it will fail the negotiation.
+				if errorPrefix == "" || !bytes.HasPrefix(challenge, []byte(errorPrefix)) {
+					return false, nil, nil, ErrInvalidChallenge
+				}
+				return true, []byte{'='}, nil, nil
+			}
+			return false, nil, nil, ErrTooManySteps
+		},
+	}
+}
+
+func redirectServerNext(name, errorPrefix string, s *redirectServer, m *Negotiator, challenge []byte, data interface{}) (more bool, resp []byte, cache interface{}, err error) {
+	switch m.State() & StepMask {
+	case AuthTextSent:
+		header, identifier, err := parseGS2Header(challenge)
+		if err != nil {
+			return false, nil, nil, err
+		}
+		if err = checkGS2Header(name, m, header); err != nil {
+			return false, nil, nil, err
+		}
+		if len(identifier) == 0 {
+			return false, nil, nil, ErrInvalidChallenge
+		}
+
+		redirect, state, err := s.redirect(m, identifier)
+		if err != nil {
+			return false, nil, nil, err
+		}
+		return true, []byte(redirect), &redirectServerState{
+			identifier: identifier,
+			identity:   header.identity,
+			state:      state,
+		}, nil
+	case ResponseSent:
+		if string(challenge) != "=" {
+			return false, nil, nil, ErrInvalidChallenge
+		}
+		state, ok := data.(*redirectServerState)
+		if !ok {
+			return false, nil, nil, ErrInvalidState
+		}
+		username, err := s.verify(m, state.identifier, state.state)
+		if err == nil && username == nil {
+			err = ErrAuthn
+		}
+		if err != nil {
+			if errorPrefix == "" {
+				return false, nil, nil, err
+			}
+			state.err = err
+			return true, []byte(errorPrefix + err.Error()), state, nil
+		}
+
+		identity := state.identity
+		if !m.Permissions(Credentials(func() (Username, Password, Identity []byte) {
+			return username, nil, identity
+		})) {
+			return false, nil, nil, ErrAuthn
+		}
+		return false, nil, nil, nil
+	case ValidServerResponse:
+		// The client acknowledged the error challenge.
+		state, ok := data.(*redirectServerState)
+		if !ok {
+			return false, nil, nil, ErrInvalidState
+		}
+		if state.err == nil || string(challenge) != "=" {
+			return false, nil, nil, ErrInvalidChallenge
+		}
+		return false, nil, nil, state.err
+	}
+	return false, nil, nil, ErrTooManySteps
+}
@@ -0,0 +1,111 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"sort"
+	"sync"
+)
+
+// A Registry maps mechanism names, as registered with IANA and sent on the
+// wire, to functions that construct the mechanism.
+// It can be used by servers to create a Negotiator for the mechanism chosen by
+// the client.
+// A Registry is safe for concurrent use.
+type Registry struct {
+	mu         sync.RWMutex
+	mechanisms map[string]func() Mechanism
+}
+
+// NewRegistry returns a Registry containing the builtin mechanisms that are not
+// constructed from arguments: PLAIN, CRAM-MD5, and the SCRAM and HT-SHA-256
+// families.
+// Servers still need options to use most of them: CRAM-MD5 needs Secret, the
+// SCRAM family needs ScramCredentials, and the HT-SHA-256 family needs
+// HTTokens.
+// Mechanisms that are constructed from arguments, such as DigestMD5 and
+// GS2KRB5, and custom mechanisms can be added with Register.
+func NewRegistry() *Registry {
+	r := &Registry{}
+	for _, m := range []Mechanism{
+		Plain, CramMD5,
+		ScramSha1, ScramSha1Plus, ScramSha256, ScramSha256Plus,
+		HTSha256None, HTSha256Uniq, HTSha256Endp, HTSha256Expr,
+	} {
+		m := m
+		r.Register(m.Name, func() Mechanism {
+			return m
+		})
+	}
+	return r
+}
+
+// Register adds a mechanism to the registry under name, replacing any
+// mechanism previously registered with the same name.
+func (r *Registry) Register(name string, f func() Mechanism) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.mechanisms == nil {
+		r.mechanisms = make(map[string]func() Mechanism)
+	}
+	r.mechanisms[name] = f
+}
+
+// Lookup constructs the mechanism registered under name.
+func (r *Registry) Lookup(name string) (Mechanism, bool) {
+	r.mu.RLock()
+	f, ok := r.mechanisms[name]
+	r.mu.RUnlock()
+	if !ok {
+		return Mechanism{}, false
+	}
+	return f(), true
+}
+
+// Names returns the names of all registered mechanisms in sorted order.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	names := make([]string, 0, len(r.mechanisms))
+	for name := range r.mechanisms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Mechanisms constructs all registered mechanisms, sorted by name.
+func (r *Registry) Mechanisms() []Mechanism {
+	names := r.Names()
+	ms := make([]Mechanism, 0, len(names))
+	for _, name := range names {
+		if m, ok := r.Lookup(name); ok {
+			ms = append(ms, m)
+		}
+	}
+	return ms
+}
+
+// NewClient creates a client Negotiator using the mechanism registered under
+// name.
+// If no such mechanism exists ErrNoMechanism is returned.
+func (r *Registry) NewClient(name string, opts ...Option) (*Negotiator, error) {
+	m, ok := r.Lookup(name)
+	if !ok {
+		return nil, ErrNoMechanism
+	}
+	return NewClient(m, opts...), nil
+}
+
+// NewServer creates a server Negotiator using the mechanism registered under
+// name, normally the name selected by the client.
+// If no such mechanism exists ErrNoMechanism is returned.
+func (r *Registry) NewServer(name string, permissions func(*Negotiator) bool, opts ...Option) (*Negotiator, error) {
+	m, ok := r.Lookup(name)
+	if !ok {
+		return nil, ErrNoMechanism
+	}
+	return NewServer(m, permissions, opts...), nil
+}
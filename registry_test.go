@@ -0,0 +1,67 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	r := NewRegistry()
+
+	want := []string{
+		"CRAM-MD5",
+		"HT-SHA-256-ENDP", "HT-SHA-256-EXPR", "HT-SHA-256-NONE", "HT-SHA-256-UNIQ",
+		"PLAIN",
+		"SCRAM-SHA-1", "SCRAM-SHA-1-PLUS", "SCRAM-SHA-256", "SCRAM-SHA-256-PLUS",
+	}
+	if names := r.Names(); !reflect.DeepEqual(names, want) {
+		t.Fatalf("Unexpected builtin mechanisms: want=%v, got=%v", want, names)
+	}
+
+	if _, err := r.NewServer("XOAUTH2", acceptAll); err != ErrNoMechanism {
+		t.Fatalf("Expected ErrNoMechanism for unregistered mechanism, got %v", err)
+	}
+	r.Register("XOAUTH2", func() Mechanism {
+		return Mechanism{Name: "XOAUTH2", Start: plain.Start, Next: plain.Next}
+	})
+	if _, ok := r.Lookup("XOAUTH2"); !ok {
+		t.Fatalf("Registered mechanism was not found")
+	}
+	if ms := r.Mechanisms(); len(ms) != len(want)+1 || ms[len(ms)-1].Name != "XOAUTH2" {
+		t.Fatalf("Registered mechanism missing from mechanism list: %v", ms)
+	}
+
+	server, err := r.NewServer("PLAIN", acceptAll)
+	if err != nil {
+		t.Fatalf("Unexpected error creating server: %v", err)
+	}
+	if server.State()&Receiving != Receiving {
+		t.Fatalf("Expected a server negotiator")
+	}
+	if _, _, err = server.Step(plainResp); err != nil {
+		t.Fatalf("Unexpected error stepping server: %v", err)
+	}
+
+	client, err := r.NewClient("SCRAM-SHA-1")
+	if err != nil {
+		t.Fatalf("Unexpected error creating client: %v", err)
+	}
+	if client.State()&Receiving == Receiving {
+		t.Fatalf("Expected a client negotiator")
+	}
+}
+
+func TestZeroRegistry(t *testing.T) {
+	var r Registry
+	if _, ok := r.Lookup("PLAIN"); ok {
+		t.Fatalf("Expected zero registry to be empty")
+	}
+	r.Register("PLAIN", func() Mechanism { return Plain })
+	if _, ok := r.Lookup("PLAIN"); !ok {
+		t.Fatalf("Expected zero registry to be usable")
+	}
+}
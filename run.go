@@ -0,0 +1,177 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"context"
+)
+
+// Outcome is the kind of a message sent or received by a Transport.
+type Outcome uint8
+
+const (
+	// Challenge is a message that continues the negotiation: a challenge from
+	// the server or a response from the client.
+	Challenge Outcome = iota
+
+	// Success is sent by the server when the negotiation has succeeded.
+	// It may carry additional data that must still be processed by the client,
+	// for example the server signature in SCRAM.
+	Success
+
+	// Failure is sent by the server when the negotiation has failed, or by the
+	// client to abort the negotiation.
+	Failure
+)
+
+// A Transport sends and receives the messages of a SASL negotiation for a
+// particular protocol.
+// It is responsible for any framing and encoding (such as base64) that the
+// protocol requires.
+//
+// When a client has no initial response, or a server received none, the data
+// is nil.
+// This must be kept distinct from an empty initial response, which is a
+// non-nil, zero length slice.
+type Transport interface {
+	Send(ctx context.Context, o Outcome, data []byte) error
+	Receive(ctx context.Context) (o Outcome, data []byte, err error)
+}
+
+// Run performs an entire negotiation using n, sending and receiving messages
+// with t until the negotiation succeeds or fails.
+// Whether n acts as a client or server depends on how it was created.
+//
+// If the remote side reports a failure or aborts the negotiation, ErrAuthn is
+// returned.
+// Errors returned by the transport are returned unchanged.
+// If an error is returned the negotiation is abandoned and n is closed.
+//
+// A server Negotiator returned by Server.Negotiate may be passed to Run after
+// its challenge has been sent.
+func Run(ctx context.Context, n *Negotiator, t Transport) (err error) {
+	defer func() {
+		if err != nil {
+			// The original error is more useful than any error releasing the
+			// mechanism.
+			_ = n.Close()
+		}
+	}()
+	if n.State()&Receiving == Receiving {
+		return runServer(ctx, n, t)
+	}
+	return runClient(ctx, n, t)
+}
+
+func runClient(ctx context.Context, n *Negotiator, t Transport) error {
+	more := true
+	if !n.mechanism.ServerFirst {
+		var resp []byte
+		var err error
+		more, resp, err = n.StepContext(ctx, nil)
+		if err != nil {
+			return err
+		}
+		if err = t.Send(ctx, Challenge, resp); err != nil {
+			return err
+		}
+	}
+
+	for {
+		o, data, err := t.Receive(ctx)
+		if err != nil {
+			return err
+		}
+
+		switch o {
+		case Failure:
+			return ErrAuthn
+		case Success:
+			if !more {
+				if len(data) > 0 {
+					return ErrInvalidChallenge
+				}
+				return nil
+			}
+			// The mechanism still needs to see the additional data (if any) to
+			// finish, eg. to authenticate the server.
+			more, _, err = n.StepContext(ctx, data)
+			if err != nil {
+				return err
+			}
+			if more {
+				// The server claims we're done, but the mechanism disagrees.
+				return ErrAuthn
+			}
+			return nil
+		}
+
+		var resp []byte
+		more, resp, err = n.StepContext(ctx, data)
+		if err != nil {
+			// Let the server know that we're giving up. The original error is more
+			// useful than any error that occurs while aborting.
+			_ = t.Send(ctx, Failure, nil)
+			return err
+		}
+		if err = t.Send(ctx, Challenge, resp); err != nil {
+			return err
+		}
+	}
+}
+
+func runServer(ctx context.Context, n *Negotiator, t Transport) error {
+	if n.State()&StepMask == Initial {
+		_, challenge, err := n.StepContext(ctx, nil)
+		if err != nil {
+			_ = t.Send(ctx, Failure, nil)
+			return err
+		}
+		if err = t.Send(ctx, Challenge, challenge); err != nil {
+			return err
+		}
+	}
+
+	for {
+		o, data, err := t.Receive(ctx)
+		if err != nil {
+			return err
+		}
+
+		switch o {
+		case Failure:
+			// The client aborted the negotiation.
+			return ErrAuthn
+		case Success:
+			// Only servers may report success.
+			_ = t.Send(ctx, Failure, nil)
+			return ErrInvalidChallenge
+		}
+
+		// If the client did not send an initial response for a client-first
+		// mechanism, send an empty challenge to ask for one.
+		// It is only asked for once and an empty response after that is passed to
+		// the mechanism.
+		if data == nil && n.Round() == 0 && !n.requested {
+			n.requested = true
+			if err = t.Send(ctx, Challenge, []byte{}); err != nil {
+				return err
+			}
+			continue
+		}
+
+		more, challenge, err := n.StepContext(ctx, data)
+		if err != nil {
+			_ = t.Send(ctx, Failure, nil)
+			return err
+		}
+		if !more {
+			return t.Send(ctx, Success, challenge)
+		}
+		if err = t.Send(ctx, Challenge, challenge); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"io"
+	"strconv"
+	"testing"
+)
+
+type message struct {
+	o    Outcome
+	data string
+	null bool
+}
+
+// scriptTransport replays received messages and records sent ones.
+type scriptTransport struct {
+	recv []message
+	sent []message
+}
+
+func (t *scriptTransport) Send(_ context.Context, o Outcome, data []byte) error {
+	t.sent = append(t.sent, message{o: o, data: string(data), null: data == nil})
+	return nil
+}
+
+func (t *scriptTransport) Receive(context.Context) (Outcome, []byte, error) {
+	if len(t.recv) == 0 {
+		return Failure, nil, io.EOF
+	}
+	m := t.recv[0]
+	t.recv = t.recv[1:]
+	if m.null {
+		return m.o, nil, nil
+	}
+	return m.o, []byte(m.data), nil
+}
+
+var runTestCases = [...]struct {
+	n    func() *Negotiator
+	recv []message
+	sent []message
+	err  error
+}{
+	0: {
+		n: func() *Negotiator {
+			return NewClient(plain, plainClientOpts...)
+		},
+		recv: []message{{o: Success}},
+		sent: []message{{o: Challenge, data: string(plainResp)}},
+	},
+	1: {
+		n: func() *Negotiator {
+			return NewClient(plain, plainClientOpts...)
+		},
+		recv: []message{{o: Failure}},
+		sent: []message{{o: Challenge, data: string(plainResp)}},
+		err:  ErrAuthn,
+	},
+	2: {
+		n: func() *Negotiator {
+			c := NewClient(scram("SCRAM-SHA-1", sha1.New), Credentials(func() ([]byte, []byte, []byte) {
+				return []byte("user"), []byte("pencil"), nil
+			}))
+			c.nonce = testNonce
+			return c
+		},
+		recv: []message{
+			{o: Challenge, data: `r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096`},
+			{o: Success, data: `v=rmF9pqV8S7suAoZWja4dJRkFsKQ=`},
+		},
+		sent: []message{
+			{o: Challenge, data: `n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL`},
+			{o: Challenge, data: `c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=`},
+		},
+	},
+	3: {
+		// Invalid server signature sent as additional data with success.
+		n: func() *Negotiator {
+			c := NewClient(scram("SCRAM-SHA-1", sha1.New), Credentials(func() ([]byte, []byte, []byte) {
+				return []byte("user"), []byte("pencil"), nil
+			}))
+			c.nonce = testNonce
+			return c
+		},
+		recv: []message{
+			{o: Challenge, data: `r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096`},
+			{o: Success, data: `v=AAAA`},
+		},
+		sent: []message{
+			{o: Challenge, data: `n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL`},
+			{o: Challenge, data: `c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=`},
+		},
+		err: ErrAuthn,
+	},
+	4: {
+		// No initial response, so the server asks for one.
+		n: func() *Negotiator {
+			return NewServer(plain, acceptAll)
+		},
+		recv: []message{
+			{o: Challenge, null: true},
+			{o: Challenge, data: string(plainResp)},
+		},
+		sent: []message{
+			{o: Challenge, data: ""},
+			{o: Success, null: true},
+		},
+	},
+	5: {
+		n: func() *Negotiator {
+			return NewServer(plain, nil)
+		},
+		recv: []message{{o: Challenge, data: string(plainResp)}},
+		sent: []message{{o: Failure, null: true}},
+		err:  ErrAuthn,
+	},
+	6: {
+		// The client aborts.
+		n: func() *Negotiator {
+			return NewServer(cramMD5, acceptAll)
+		},
+		recv: []message{{o: Failure, null: true}},
+		err:  ErrAuthn,
+	},
+	7: {
+		// The transport fails.
+		n: func() *Negotiator {
+			return NewClient(cramMD5, plainClientOpts...)
+		},
+		err: io.EOF,
+	},
+	8: {
+		// The client never sends a response, so the server only asks for one
+		// once.
+		n: func() *Negotiator {
+			return NewServer(plain, acceptAll)
+		},
+		recv: []message{
+			{o: Challenge, null: true},
+			{o: Challenge, null: true},
+			{o: Challenge, null: true},
+		},
+		sent: []message{
+			{o: Challenge, data: ""},
+			{o: Failure, null: true},
+		},
+		err: ErrInvalidChallenge,
+	},
+}
+
+func TestRunClose(t *testing.T) {
+	for i, tc := range [...]struct {
+		server bool
+		recv   []message
+	}{
+		0: {recv: []message{{o: Failure, null: true}}},
+		1: {},
+		2: {server: true, recv: []message{{o: Challenge, data: "0"}, {o: Failure, null: true}}},
+		3: {server: true, recv: []message{{o: Challenge, data: "0"}}},
+		4: {server: true, recv: []message{{o: Challenge, data: "0"}, {o: Success, null: true}}},
+	} {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			var closed int
+			m := SessionMechanism("COUNT", func(n *Negotiator) (Session, error) {
+				return &countSession{steps: 3, closed: &closed}, nil
+			})
+			n := NewClient(m)
+			if tc.server {
+				n = NewServer(m, acceptAll)
+			}
+			if err := Run(context.Background(), n, &scriptTransport{recv: tc.recv}); err == nil {
+				t.Fatal("Expected the negotiation to fail")
+			}
+			if closed != 1 {
+				t.Errorf("Expected the abandoned session to be closed once, got %d", closed)
+			}
+		})
+	}
+}
+
+func TestRunAfterNegotiate(t *testing.T) {
+	s := &Server{Permissions: acceptAll, Options: []Option{TLSState(tls.ConnectionState{TLSUnique: []byte{0, 1, 2, 3, 4}})}}
+	n, more, challenge, err := s.Negotiate(context.Background(), "PLAIN", nil)
+	if err != nil || !more || challenge == nil || len(challenge) != 0 {
+		t.Fatalf("Unexpected result: more=%v challenge=%q err=%v", more, challenge, err)
+	}
+	// The initial response was already requested, so an empty response is
+	// passed to the mechanism instead of being requested again.
+	tr := &scriptTransport{recv: []message{{o: Challenge, null: true}}}
+	if err = Run(context.Background(), n, tr); err != ErrInvalidChallenge {
+		t.Errorf("Unexpected error: want=%v, got=%v", ErrInvalidChallenge, err)
+	}
+	if len(tr.sent) != 1 || tr.sent[0].o != Failure {
+		t.Errorf("Expected only a failure to be sent, got %v", tr.sent)
+	}
+}
+
+func TestRun(t *testing.T) {
+	for i, tc := range runTestCases {
+		t.Run(strconv.Itoa(i), func(t *testing.T) {
+			tr := &scriptTransport{recv: tc.recv}
+			n := tc.n()
+			err := Run(context.Background(), n, tr)
+			if err != tc.err {
+				t.Fatalf("Unexpected error: want=%v, got=%v", tc.err, err)
+			}
+			// The server challenge for CRAM-MD5 is random, so only check its kind.
+			if n.mechanism.Name == cramMD5.Name && len(tr.sent) > 0 {
+				if tr.sent[0].o != Challenge {
+					t.Fatalf("Expected server to send a challenge first")
+				}
+				tr.sent = tr.sent[1:]
+			}
+			if len(tr.sent) != len(tc.sent) {
+				t.Fatalf("Wrong number of messages sent: want=%d, got=%d (%v)", len(tc.sent), len(tr.sent), tr.sent)
+			}
+			for j, m := range tc.sent {
+				if tr.sent[j] != m {
+					t.Errorf("Unexpected message %d: want=%+v, got=%+v", j, m, tr.sent[j])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"net/url"
+	"time"
+)
+
+const samlPOSTBinding = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+
+// SAMLConfig configures the SAML20 mechanism.
+// Clients only use Browser, and servers, which act as a SAML service provider,
+// use the other fields.
+type SAMLConfig struct {
+	// Browser is used by clients to send the user to the URL returned by the
+	// server.
+	// It should open the URL in a web browser (or instruct the user to do so)
+	// and return once the user has finished authenticating with the identity
+	// provider.
+	// If the user may never finish, it should stop waiting when the context
+	// returned by the negotiators Context method is canceled.
+	Browser func(n *Negotiator, url string) error
+
+	// Issuer is the entity ID of the service provider.
+	Issuer string
+
+	// AssertionConsumerServiceURL is the URL that the identity provider sends
+	// its response to using the HTTP-POST binding.
+	// Receiving the response is up to the application.
+	AssertionConsumerServiceURL string
+
+	// IdentityProvider returns the single sign-on URL (using the HTTP-Redirect
+	// binding) of the identity provider named by the client.
+	// The identifier is either a URI or a domain name as described in RFC 6595.
+	// If the identity provider is unknown or not trusted it should return an
+	// error.
+	IdentityProvider func(n *Negotiator, idp []byte) (ssoURL string, err error)
+
+	// VerifyAssertion is called once the client reports that the user has
+	// finished authenticating.
+	// It should wait for the response to the request with the given ID to
+	// arrive at the assertion consumer service, validate it and the assertion
+	// it contains, and return the authenticated subject.
+	// If no valid assertion was received it should return a nil username or an
+	// error.
+	VerifyAssertion func(n *Negotiator, idp []byte, requestID string) (username []byte, err error)
+}
+
+type samlAuthnRequest struct {
+	XMLName                     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	ID                          string   `xml:",attr"`
+	Version                     string   `xml:",attr"`
+	IssueInstant                string   `xml:",attr"`
+	Destination                 string   `xml:",attr"`
+	ProtocolBinding             string   `xml:",attr"`
+	AssertionConsumerServiceURL string   `xml:",attr"`
+	Issuer                      string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+}
+
+func saml20(c SAMLConfig) Mechanism {
+	var server *redirectServer
+	if c.IdentityProvider != nil && c.VerifyAssertion != nil {
+		server = &redirectServer{
+			redirect: func(n *Negotiator, idp []byte) (string, interface{}, error) {
+				sso, err := c.IdentityProvider(n, idp)
+				if err != nil {
+					return "", nil, err
+				}
+				id, redirect, err := samlRedirect(&c, sso)
+				return redirect, id, err
+			},
+			verify: func(n *Negotiator, idp []byte, state interface{}) ([]byte, error) {
+				requestID, ok := state.(string)
+				if !ok {
+					return nil, ErrInvalidState
+				}
+				return c.VerifyAssertion(n, idp, requestID)
+			},
+		}
+	}
+	return redirectMechanism("SAML20", "", c.Browser, server)
+}
+
+// samlRedirect builds an AuthnRequest for the identity provider and encodes it
+// in its single sign-on URL using the HTTP-Redirect binding.
+// The request is not signed.
+func samlRedirect(c *SAMLConfig, sso string) (id, redirect string, err error) {
+	u, err := url.Parse(sso)
+	if err != nil {
+		return "", "", err
+	}
+
+	// IDs are of type xs:ID and cannot start with a digit.
+	b := make([]byte, 20)
+	if _, err = rand.Read(b); err != nil {
+		return "", "", err
+	}
+	id = "_" + hex.EncodeToString(b)
+
+	req, err := xml.Marshal(samlAuthnRequest{
+		ID:                          id,
+		Version:                     "2.0",
+		IssueInstant:                time.Now().UTC().Format("2006-01-02T15:04:05Z"),
+		Destination:                 sso,
+		ProtocolBinding:             samlPOSTBinding,
+		AssertionConsumerServiceURL: c.AssertionConsumerServiceURL,
+		Issuer:                      c.Issuer,
+	})
+	if err != nil {
+		return "", "", err
+	}
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err = w.Write(req); err != nil {
+		return "", "", err
+	}
+	if err = w.Close(); err != nil {
+		return "", "", err
+	}
+
+	q := u.Query()
+	q.Set("SAMLRequest", base64.StdEncoding.EncodeToString(buf.Bytes()))
+	u.RawQuery = q.Encode()
+	return id, u.String(), nil
+}
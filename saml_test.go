@@ -0,0 +1,202 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const (
+	testSSOURL = "https://idp.example.net/sso?tenant=1"
+	testACSURL = "https://sp.example.com/acs"
+	testIssuer = "https://sp.example.com/"
+)
+
+var errUnknownIdP = errors.New("unknown identity provider")
+
+// samlIdP is a stand-in identity provider.
+// Its browser function plays the part of the user agent: it decodes the
+// AuthnRequest and, if the user logs in, "posts" an assertion for the request
+// to the service providers assertion consumer service.
+type samlIdP struct {
+	t        *testing.T
+	user     string
+	received map[string]string
+}
+
+func (idp *samlIdP) browser(_ *Negotiator, redirect string) error {
+	u, err := url.Parse(redirect)
+	if err != nil {
+		return err
+	}
+	if u.Scheme+"://"+u.Host+u.Path != "https://idp.example.net/sso" || u.Query().Get("tenant") != "1" {
+		idp.t.Errorf("Unexpected redirect URL: %s", redirect)
+	}
+	deflated, err := base64.StdEncoding.DecodeString(u.Query().Get("SAMLRequest"))
+	if err != nil {
+		return err
+	}
+	req, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	if err != nil {
+		return err
+	}
+	var authnRequest samlAuthnRequest
+	if err = xml.Unmarshal(req, &authnRequest); err != nil {
+		return err
+	}
+	if authnRequest.Issuer != testIssuer || authnRequest.AssertionConsumerServiceURL != testACSURL ||
+		authnRequest.Destination != testSSOURL || authnRequest.Version != "2.0" {
+		idp.t.Errorf("Unexpected AuthnRequest: %s", req)
+	}
+	if !strings.HasPrefix(authnRequest.ID, "_") {
+		idp.t.Errorf("Invalid request ID: %q", authnRequest.ID)
+	}
+
+	// The user closed the browser without logging in.
+	if idp.user == "" {
+		return nil
+	}
+	idp.received[authnRequest.ID] = idp.user
+	return nil
+}
+
+func (idp *samlIdP) config() SAMLConfig {
+	return SAMLConfig{
+		Issuer:                      testIssuer,
+		AssertionConsumerServiceURL: testACSURL,
+		IdentityProvider: func(_ *Negotiator, name []byte) (string, error) {
+			if string(name) != "example.net" {
+				return "", errUnknownIdP
+			}
+			return testSSOURL, nil
+		},
+		VerifyAssertion: func(_ *Negotiator, name []byte, requestID string) ([]byte, error) {
+			user, ok := idp.received[requestID]
+			if !ok {
+				return nil, nil
+			}
+			delete(idp.received, requestID)
+			return []byte(user), nil
+		},
+	}
+}
+
+func TestSAML20(t *testing.T) {
+	for _, tc := range [...]struct {
+		name      string
+		idp       string
+		identity  string
+		user      string
+		noBrowser bool
+		clientErr bool
+		serverErr error
+	}{
+		{name: "Valid", idp: "example.net", user: "juliet@example.net"},
+		{name: "Identity", idp: "example.net", identity: "romeo@example.net", user: "juliet@example.net"},
+		{name: "NotLoggedIn", idp: "example.net", serverErr: ErrAuthn},
+		{name: "UnknownIdP", idp: "example.org", user: "juliet@example.net", serverErr: errUnknownIdP},
+		{name: "NoIdP", user: "juliet@example.net", clientErr: true},
+		{name: "NoBrowser", idp: "example.net", user: "juliet@example.net", noBrowser: true, clientErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			idp := &samlIdP{t: t, user: tc.user, received: make(map[string]string)}
+			name, identity := tc.idp, tc.identity
+			var clientConfig SAMLConfig
+			if !tc.noBrowser {
+				clientConfig.Browser = idp.browser
+			}
+			var gotUser, gotIdentity string
+			perm := func(n *Negotiator) bool {
+				u, _, i := n.Credentials()
+				gotUser, gotIdentity = string(u), string(i)
+				return true
+			}
+			client := NewClient(SAML20(clientConfig), Credentials(func() ([]byte, []byte, []byte) {
+				return []byte(name), nil, []byte(identity)
+			}))
+			server := NewServer(SAML20(idp.config()), perm)
+
+			clientErr, serverErr := stepPair(client, server)
+			if (clientErr != nil) != tc.clientErr {
+				t.Errorf("Unexpected client error: %v", clientErr)
+			}
+			if serverErr != tc.serverErr {
+				t.Errorf("Unexpected server error: want=%v, got=%v", tc.serverErr, serverErr)
+			}
+			if tc.clientErr || tc.serverErr != nil {
+				return
+			}
+			if gotUser != tc.user || gotIdentity != tc.identity {
+				t.Errorf("Unexpected credentials: want=%q/%q, got=%q/%q", tc.user, tc.identity, gotUser, gotIdentity)
+			}
+			if len(idp.received) != 0 {
+				t.Errorf("Assertion was not consumed")
+			}
+		})
+	}
+}
+
+func TestSAML20Server(t *testing.T) {
+	idp := &samlIdP{t: t, user: "juliet@example.net", received: make(map[string]string)}
+	for _, tc := range [...]struct {
+		name    string
+		initial string
+		err     bool
+	}{
+		{name: "NoChannelBinding", initial: "n,,example.net"},
+		{name: "ChannelBinding", initial: "p=tls-unique,,example.net", err: true},
+		{name: "NoHeader", initial: "example.net", err: true},
+		{name: "NoIdP", initial: "n,,", err: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := NewServer(SAML20(idp.config()), acceptAll)
+			more, redirect, err := server.Step([]byte(tc.initial))
+			if tc.err {
+				if err == nil {
+					t.Errorf("Expected an error")
+				}
+				return
+			}
+			if err != nil || !more {
+				t.Fatalf("Unexpected result: more=%t, err=%v", more, err)
+			}
+			if !strings.HasPrefix(string(redirect), "https://idp.example.net/sso?") {
+				t.Errorf("Unexpected redirect URL: %s", redirect)
+			}
+			if _, _, err = server.Step([]byte("x")); err != ErrInvalidChallenge {
+				t.Errorf("Expected ErrInvalidChallenge for a response other than =, got %v", err)
+			}
+		})
+	}
+
+	// A server that was not configured cannot authenticate anyone.
+	server := NewServer(SAML20(SAMLConfig{}), acceptAll)
+	if _, _, err := server.Step([]byte("n,,example.net")); err != ErrAuthn {
+		t.Errorf("Expected ErrAuthn from an unconfigured server, got %v", err)
+	}
+}
+
+func TestSAML20Client(t *testing.T) {
+	// SAML20 has no -PLUS variant so the "y" flag, which tells the server that
+	// one was expected, must never be sent even if TLS is in use.
+	client := NewClient(SAML20(SAMLConfig{}), TLSState(scramTLS), RemoteMechanisms("SAML20"), Credentials(func() ([]byte, []byte, []byte) {
+		return []byte("example.net"), nil, []byte("romeo@example.net")
+	}))
+	_, resp, err := client.Step(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "n,a=romeo@example.net,example.net"; string(resp) != want {
+		t.Errorf("Unexpected initial response: want=%q, got=%q", want, resp)
+	}
+}
@@ -5,6 +5,7 @@
 package sasl
 
 import (
+	"context"
 	"crypto/sha1"
 	"crypto/sha256"
 	"crypto/tls"
@@ -29,6 +30,7 @@ type saslTest struct {
 	serverOpts []Option
 	perm       func(*Negotiator) bool
 	steps      []saslStep
+	nonce      []byte
 	skipClient bool
 	skipServer bool
 }
@@ -316,6 +318,181 @@ var saslTestCases = [...]saslTest{
 			{resp: []byte("Ursel\x00Kurt\x00xipj3plmq\x00"), serverErr: true, more: false},
 		},
 	},
+	16: {
+		skipServer: true,
+		mechanism:  cramMD5,
+		clientOpts: []Option{Credentials(func() ([]byte, []byte, []byte) {
+			return []byte("tim"), []byte("tanstaaftanstaaf"), nil
+		})},
+		steps: []saslStep{
+			{
+				challenge: []byte("<1896.697170952@postoffice.reston.mci.net>"),
+				resp:      []byte("tim b913a602c7eda7a495b4e6e7334d3890"),
+				more:      false,
+			},
+			{challenge: nil, resp: nil, clientErr: true, more: false},
+		},
+	},
+	17: {
+		skipClient: true,
+		mechanism:  cramMD5,
+		perm:       acceptAll,
+		steps: []saslStep{
+			{resp: []byte("tim"), serverErr: true, more: false},
+		},
+	},
+	18: {
+		skipServer: true,
+		mechanism:  digestMD5("imap/elwood.innosoft.com"),
+		nonce:      []byte("OA6MHXh6VqTrRk"),
+		clientOpts: []Option{Credentials(func() ([]byte, []byte, []byte) {
+			return []byte("chris"), []byte("secret"), nil
+		})},
+		steps: []saslStep{
+			{
+				challenge: []byte(`realm="elwood.innosoft.com",nonce="OA6MG9tEQGm2hh",qop="auth",algorithm=md5-sess,charset=utf-8`),
+				resp:      []byte(`charset=utf-8,username="chris",realm="elwood.innosoft.com",nonce="OA6MG9tEQGm2hh",nc=00000001,cnonce="OA6MHXh6VqTrRk",digest-uri="imap/elwood.innosoft.com",response=d388dad90d4bbd760a152321f2143af7,qop=auth`),
+				more:      true,
+			},
+			{
+				challenge: []byte(`rspauth=ea40f60335c427b5527b84dbabcdfffd`),
+				resp:      nil,
+				more:      false,
+			},
+		},
+	},
+	19: {
+		skipServer: true,
+		mechanism:  digestMD5("imap/elwood.innosoft.com"),
+		nonce:      []byte("OA6MHXh6VqTrRk"),
+		clientOpts: []Option{Credentials(func() ([]byte, []byte, []byte) {
+			return []byte("chris"), []byte("secret"), nil
+		})},
+		steps: []saslStep{
+			{
+				challenge: []byte(`realm="elwood.innosoft.com",nonce="OA6MG9tEQGm2hh",qop="auth",algorithm=md5-sess,charset=utf-8`),
+				resp:      []byte(`charset=utf-8,username="chris",realm="elwood.innosoft.com",nonce="OA6MG9tEQGm2hh",nc=00000001,cnonce="OA6MHXh6VqTrRk",digest-uri="imap/elwood.innosoft.com",response=d388dad90d4bbd760a152321f2143af7,qop=auth`),
+				more:      true,
+			},
+			{challenge: []byte(`rspauth=00000000000000000000000000000000`), clientErr: true},
+		},
+	},
+	20: {
+		skipServer: true,
+		mechanism:  digestMD5("ldap/ldap.example.net"),
+		clientOpts: []Option{Credentials(func() ([]byte, []byte, []byte) {
+			return []byte("chris"), []byte("secret"), nil
+		})},
+		steps: []saslStep{
+			{challenge: []byte(`nonce="abc",qop="auth-int",algorithm=md5-sess`), clientErr: true},
+		},
+	},
+	21: {
+		skipServer: true,
+		mechanism:  scram("SCRAM-SHA-1", sha1.New),
+		clientOpts: []Option{
+			Credentials(func() ([]byte, []byte, []byte) {
+				return []byte("user"), []byte("pencil"), nil
+			}),
+			SecondFactor(func(*Negotiator) ([]byte, error) {
+				return []byte("123456"), nil
+			}),
+		},
+		steps: []saslStep{
+			{
+				resp: []byte(`n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL`),
+				more: true,
+			},
+			{
+				challenge: []byte(`r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096`),
+				resp:      []byte(`c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,t=123456,p=TRgZAAQ0KJvPUjV/IWWPuvRmaHI=`),
+				more:      true,
+			},
+			{
+				challenge: []byte(`v=ePavV1aPLu0yXtccu9CH9YdYJ8c=`),
+				resp:      nil,
+				more:      false,
+			},
+		},
+	},
+	22: {
+		skipServer: true,
+		mechanism:  scram("SCRAM-SHA-256", sha256.New),
+		clientOpts: []Option{
+			Credentials(func() ([]byte, []byte, []byte) {
+				return []byte("user"), []byte("pencil"), nil
+			}),
+			SecondFactor(func(*Negotiator) ([]byte, error) {
+				return []byte("287082"), nil
+			}),
+		},
+		steps: []saslStep{
+			{
+				resp: []byte("n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL"),
+				more: true,
+			},
+			{
+				challenge: []byte(`r=fyko+d2lbbFgONRv9qkxdawL%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096`),
+				resp:      []byte(`c=biws,r=fyko+d2lbbFgONRv9qkxdawL%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,t=287082,p=xN8XFE65MaJOUPBhPMwAdLu/CTMSOvx20ABytgTHUOE=`),
+				more:      true,
+			},
+			{
+				challenge: []byte(`v=T8/ANyfd0GQ0Y1UcNW6e3sIFg51T5S4kTdF6nz4iIsk=`),
+				resp:      nil,
+				more:      false,
+			},
+		},
+	},
+	// The server side of DIGEST-MD5 is not implemented and must fail instead of
+	// panicking.
+	23: {
+		skipClient: true,
+		mechanism:  digestMD5("ldap/ldap.example.net"),
+		perm:       acceptAll,
+		steps: []saslStep{
+			{serverErr: true},
+		},
+	},
+	// The SCRAM-SHA-1 test vector from RFC 5802 §5.
+	24: {
+		skipClient: true,
+		mechanism:  scram("SCRAM-SHA-1", sha1.New),
+		serverOpts: []Option{ScramCredentials(vectorCredentials("QSXCR+Q6sek8bf92"))},
+		perm:       acceptAll,
+		nonce:      []byte("3rfcNHYJY1ZVvWVs7j"),
+		steps: []saslStep{
+			{
+				resp:      []byte("n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL"),
+				challenge: []byte("r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096"),
+				more:      true,
+			},
+			{
+				resp:      []byte("c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts="),
+				challenge: []byte("v=rmF9pqV8S7suAoZWja4dJRkFsKQ="),
+				more:      false,
+			},
+		},
+	},
+	// The SCRAM-SHA-256 test vector from RFC 7677 §3.
+	25: {
+		skipClient: true,
+		mechanism:  scram("SCRAM-SHA-256", sha256.New),
+		serverOpts: []Option{ScramCredentials(vectorCredentials("W22ZaJ0SNY7soEsUEjb6gQ=="))},
+		perm:       acceptAll,
+		nonce:      []byte("%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"),
+		steps: []saslStep{
+			{
+				resp:      []byte("n,,n=user,r=rOprNGfwEbeRWgbNEkqO"),
+				challenge: []byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"),
+				more:      true,
+			},
+			{
+				resp:      []byte("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="),
+				challenge: []byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="),
+				more:      false,
+			},
+		},
+	},
 }
 
 func testClient(t *testing.T, client *Negotiator, tc saslTest, run int) {
@@ -392,6 +569,10 @@ func TestSASL(t *testing.T) {
 				// an option to set the RNG and pass in a dummy one.
 				client.nonce = testNonce
 				server.nonce = testNonce
+				if tc.nonce != nil {
+					client.nonce = tc.nonce
+					server.nonce = tc.nonce
+				}
 
 				if !tc.skipClient {
 					testClient(t, client, tc, run)
@@ -406,3 +587,118 @@ func TestSASL(t *testing.T) {
 		})
 	}
 }
+
+// endless is a mechanism that never finishes and records the round it was
+// called in.
+func endless(rounds *[]int) Mechanism {
+	return Mechanism{
+		Name: "ENDLESS",
+		Start: func(n *Negotiator) (bool, []byte, interface{}, error) {
+			*rounds = append(*rounds, n.Round())
+			return true, nil, nil, nil
+		},
+		Next: func(n *Negotiator, _ []byte, _ interface{}) (bool, []byte, interface{}, error) {
+			*rounds = append(*rounds, n.Round())
+			return true, nil, nil, nil
+		},
+	}
+}
+
+func TestMaxSteps(t *testing.T) {
+	var rounds []int
+	server := NewServer(endless(&rounds), acceptAll, MaxSteps(5))
+	for run := 1; run < 3; run++ {
+		for i := 0; i < 5; i++ {
+			if _, _, err := server.Step(nil); err != nil {
+				t.Fatalf("Run %d: unexpected error on step %d: %v", run, i, err)
+			}
+		}
+		if _, _, err := server.Step(nil); err != ErrTooManySteps {
+			t.Fatalf("Run %d: expected ErrTooManySteps, got %v", run, err)
+		}
+		if server.State()&Errored != Errored {
+			t.Fatalf("Run %d: expected errored state after exceeding max steps", run)
+		}
+		if server.Round() != 5 {
+			t.Fatalf("Run %d: unexpected round: want=5, got=%d", run, server.Round())
+		}
+		server.Reset()
+	}
+	for i, r := range rounds {
+		if r != i%5 {
+			t.Fatalf("Mechanism saw wrong round: want=%d, got=%d", i%5, r)
+		}
+	}
+}
+
+type ctxKey struct{}
+
+func TestStepContext(t *testing.T) {
+	t.Run("Value", func(t *testing.T) {
+		var got interface{}
+		server := NewServer(plain, func(n *Negotiator) bool {
+			got = n.Context().Value(ctxKey{})
+			return true
+		})
+		ctx := context.WithValue(context.Background(), ctxKey{}, "value")
+		if _, _, err := server.StepContext(ctx, plainResp); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if got != "value" {
+			t.Fatalf("Permissions callback did not see the step context, got value %v", got)
+		}
+		if server.Context() != context.Background() {
+			t.Fatalf("Expected background context outside of a step")
+		}
+	})
+	t.Run("CanceledBefore", func(t *testing.T) {
+		var called bool
+		client := NewClient(Mechanism{
+			Name: "NEVER",
+			Start: func(*Negotiator) (bool, []byte, interface{}, error) {
+				called = true
+				return false, nil, nil, nil
+			},
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, _, err := client.StepContext(ctx, nil); err != context.Canceled {
+			t.Fatalf("Expected context.Canceled, got %v", err)
+		}
+		if called {
+			t.Fatalf("Mechanism should not be called with a canceled context")
+		}
+		if client.State()&Errored != Errored {
+			t.Fatalf("Expected errored state after cancellation")
+		}
+	})
+	t.Run("CanceledDuring", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		server := NewServer(plain, func(n *Negotiator) bool {
+			cancel()
+			<-n.Context().Done()
+			return false
+		})
+		if _, _, err := server.StepContext(ctx, plainResp); err != context.Canceled {
+			t.Fatalf("Expected context.Canceled, got %v", err)
+		}
+		if server.State()&Errored != Errored {
+			t.Fatalf("Expected errored state after cancellation")
+		}
+	})
+	t.Run("CanceledAfterSuccess", func(t *testing.T) {
+		// The step succeeded (and the user was authorized) before the context was
+		// checked again, so the success is reported.
+		ctx, cancel := context.WithCancel(context.Background())
+		server := NewServer(plain, func(n *Negotiator) bool {
+			cancel()
+			return true
+		})
+		if more, _, err := server.StepContext(ctx, plainResp); err != nil || more {
+			t.Fatalf("Unexpected result: more=%t, err=%v", more, err)
+		}
+		if server.State()&Errored == Errored {
+			t.Fatalf("Unexpected errored state after a successful step")
+		}
+	})
+}
@@ -0,0 +1,119 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+// Package sasltest provides utilities for testing SASL mechanisms end to end.
+package sasltest // import "github.com/mellium/sasl/sasltest"
+
+import (
+	"context"
+	"sync"
+
+	"github.com/mellium/sasl"
+)
+
+// Message is a single message in the transcript of a negotiation.
+type Message struct {
+	FromServer bool
+	Outcome    sasl.Outcome
+	Data       []byte
+}
+
+// Result is the outcome of a negotiation between a client and a server.
+type Result struct {
+	// Transcript contains every message sent by either side in order.
+	Transcript []Message
+
+	// ClientErr and ServerErr are the errors returned by the client and the
+	// server.
+	// If one side fails without telling the other, the other side's error will
+	// be context.Canceled.
+	ClientErr error
+	ServerErr error
+}
+
+// Run connects client and server in memory and negotiates until both sides
+// have finished.
+// The client and server must have been created with sasl.NewClient and
+// sasl.NewServer respectively.
+func Run(ctx context.Context, client, server *sasl.Negotiator) Result {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var res Result
+	var mu sync.Mutex
+	toServer := make(chan Message, 1)
+	toClient := make(chan Message, 1)
+	clientT := pipe{mu: &mu, res: &res, send: toServer, recv: toClient}
+	serverT := pipe{mu: &mu, res: &res, send: toClient, recv: toServer, server: true}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		err := sasl.Run(ctx, client, clientT)
+		if err != nil {
+			cancel()
+		}
+		mu.Lock()
+		res.ClientErr = err
+		mu.Unlock()
+	}()
+	go func() {
+		defer wg.Done()
+		err := sasl.Run(ctx, server, serverT)
+		if err != nil {
+			cancel()
+		}
+		mu.Lock()
+		res.ServerErr = err
+		mu.Unlock()
+	}()
+	wg.Wait()
+
+	return res
+}
+
+// pipe is one end of an in memory sasl.Transport.
+type pipe struct {
+	mu     *sync.Mutex
+	res    *Result
+	send   chan<- Message
+	recv   <-chan Message
+	server bool
+}
+
+func (p pipe) Send(ctx context.Context, o sasl.Outcome, data []byte) error {
+	m := Message{FromServer: p.server, Outcome: o}
+	if data != nil {
+		m.Data = append([]byte{}, data...)
+	}
+
+	p.mu.Lock()
+	p.res.Transcript = append(p.res.Transcript, m)
+	p.mu.Unlock()
+
+	select {
+	case p.send <- m:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p pipe) Receive(ctx context.Context) (sasl.Outcome, []byte, error) {
+	// Prefer a message that has already been sent over cancellation so that a
+	// failure message from the other side is not lost.
+	select {
+	case m := <-p.recv:
+		return m.Outcome, m.Data, nil
+	default:
+	}
+
+	select {
+	case m := <-p.recv:
+		return m.Outcome, m.Data, nil
+	case <-ctx.Done():
+		return sasl.Failure, nil, ctx.Err()
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasltest_test
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/mellium/sasl"
+	"github.com/mellium/sasl/sasltest"
+)
+
+func creds(user, pass string) sasl.Option {
+	return sasl.Credentials(func() ([]byte, []byte, []byte) {
+		return []byte(user), []byte(pass), nil
+	})
+}
+
+func secret(_ *sasl.Negotiator, username []byte) ([]byte, error) {
+	if string(username) == "user" {
+		return []byte("pencil"), nil
+	}
+	return nil, nil
+}
+
+func scramCredentials(_ *sasl.Negotiator, mechanism string, username []byte) (*sasl.ScramCredential, error) {
+	if string(username) != "user" {
+		return nil, nil
+	}
+	fn := sha1.New
+	if mechanism == "SCRAM-SHA-256" {
+		fn = sha256.New
+	}
+	cred := sasl.NewScramCredential(fn, []byte("pencil"), []byte("NaCl"), 4096)
+	return &cred, nil
+}
+
+func checkPlain(n *sasl.Negotiator) bool {
+	user, pass, _ := n.Credentials()
+	return string(user) == "user" && string(pass) == "pencil"
+}
+
+func acceptAll(*sasl.Negotiator) bool {
+	return true
+}
+
+func TestRun(t *testing.T) {
+	for _, tc := range [...]struct {
+		name      string
+		mechanism sasl.Mechanism
+		perm      func(*sasl.Negotiator) bool
+		pass      string
+		messages  int
+		clientErr error
+		serverErr error
+	}{
+		{
+			name:      "PLAIN",
+			mechanism: sasl.Plain,
+			perm:      checkPlain,
+			pass:      "pencil",
+			messages:  2,
+		},
+		{
+			name:      "PLAIN/Failure",
+			mechanism: sasl.Plain,
+			perm:      checkPlain,
+			pass:      "wrong",
+			messages:  2,
+			clientErr: sasl.ErrAuthn,
+			serverErr: sasl.ErrAuthn,
+		},
+		{
+			name:      "CRAM-MD5",
+			mechanism: sasl.CramMD5,
+			perm:      acceptAll,
+			pass:      "pencil",
+			messages:  3,
+		},
+		{
+			name:      "CRAM-MD5/Failure",
+			mechanism: sasl.CramMD5,
+			perm:      acceptAll,
+			pass:      "wrong",
+			messages:  3,
+			clientErr: sasl.ErrAuthn,
+			serverErr: sasl.ErrAuthn,
+		},
+		{
+			name:      "SCRAM-SHA-1",
+			mechanism: sasl.ScramSha1,
+			perm:      acceptAll,
+			pass:      "pencil",
+			messages:  4,
+		},
+		{
+			name:      "SCRAM-SHA-256",
+			mechanism: sasl.ScramSha256,
+			perm:      acceptAll,
+			pass:      "pencil",
+			messages:  4,
+		},
+		{
+			name:      "SCRAM-SHA-256/Failure",
+			mechanism: sasl.ScramSha256,
+			perm:      acceptAll,
+			pass:      "wrong",
+			messages:  4,
+			clientErr: sasl.ErrAuthn,
+			serverErr: sasl.ErrAuthn,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := sasl.NewClient(tc.mechanism, creds("user", tc.pass))
+			server := sasl.NewServer(tc.mechanism, tc.perm, sasl.Secret(secret), sasl.ScramCredentials(scramCredentials))
+			res := sasltest.Run(context.Background(), client, server)
+			if res.ClientErr != tc.clientErr {
+				t.Errorf("Unexpected client error: want=%v, got=%v", tc.clientErr, res.ClientErr)
+			}
+			if res.ServerErr != tc.serverErr {
+				t.Errorf("Unexpected server error: want=%v, got=%v", tc.serverErr, res.ServerErr)
+			}
+			if len(res.Transcript) != tc.messages {
+				t.Fatalf("Unexpected transcript length: want=%d, got=%d (%v)", tc.messages, len(res.Transcript), res.Transcript)
+			}
+			last := res.Transcript[len(res.Transcript)-1]
+			want := sasl.Success
+			if tc.serverErr != nil {
+				want = sasl.Failure
+			}
+			if !last.FromServer || last.Outcome != want {
+				t.Errorf("Unexpected final message: %+v", last)
+			}
+		})
+	}
+}
@@ -7,77 +7,73 @@ package sasl
 import (
 	"bytes"
 	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"hash"
+	"sort"
 	"strconv"
 	"strings"
 
 	"golang.org/x/crypto/pbkdf2"
 )
 
-const (
-	gs2HeaderCBSupport         = "p=tls-unique,"
-	gs2HeaderNoServerCBSupport = "y,"
-	gs2HeaderNoCBSupport       = "n,"
-)
-
 var (
 	clientKeyInput = []byte("Client Key")
 	serverKeyInput = []byte("Server Key")
 )
 
-// The number of random bytes to generate for a nonce.
-const noncerandlen = 16
-
-func getGS2Header(name string, n *Negotiator) (gs2Header []byte) {
-	_, _, identity := n.Credentials()
-	switch {
-	case n.TLSState() == nil || !strings.HasSuffix(name, "-PLUS"):
-		// We do not support channel binding
-		gs2Header = []byte(gs2HeaderNoCBSupport)
-	case n.State()&RemoteCB == RemoteCB:
-		// We support channel binding and the server does too
-		gs2Header = []byte(gs2HeaderCBSupport)
-	case n.State()&RemoteCB != RemoteCB:
-		// We support channel binding but the server does not
-		gs2Header = []byte(gs2HeaderNoServerCBSupport)
-	}
-	if len(identity) > 0 {
-		gs2Header = append(gs2Header, []byte(`a=`)...)
-		gs2Header = append(gs2Header, identity...)
+const (
+	// The number of random bytes to generate for a nonce.
+	noncerandlen = 16
+
+	// The number of random bytes to generate for a salt and the iteration count
+	// used by servers.
+	scramSaltLen    = 16
+	scramIterations = 4096
+)
+
+// scramMockKey is used to derive the salt sent to clients that try to log in as
+// users that do not exist.
+var scramMockKey = nonce(32, rand.Reader)
+
+// A ScramCredential is the information that a SCRAM server stores for a user
+// instead of their password, as defined in RFC 5802 §2.2.
+type ScramCredential struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewScramCredential derives the credential for a password that is stored by a
+// server for the SCRAM mechanism that uses the hash function fn.
+// It should be called when the password is set and the result stored in place
+// of the password.
+func NewScramCredential(fn func() hash.Hash, password, salt []byte, iterations int) ScramCredential {
+	saltedPassword := pbkdf2.Key(password, salt, iterations, fn().Size(), fn)
+	_, storedKey, serverKey := scramKeys(fn, saltedPassword)
+	return ScramCredential{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey,
+		ServerKey:  serverKey,
 	}
-	gs2Header = append(gs2Header, ',')
-	return
 }
 
 func scram(name string, fn func() hash.Hash) Mechanism {
-	// BUG(ssw): We need a way to cache the SCRAM client and server key
-	// calculations.
+	// BUG(ssw): We need a way to cache the SCRAM client key calculations.
+	props := NoPlaintext | MutualAuth
+	if strings.HasSuffix(name, "-PLUS") {
+		props |= ChannelBinding
+	}
 	return Mechanism{
-		Name: name,
+		Name:       name,
+		Properties: props,
 		Start: func(m *Negotiator) (bool, []byte, interface{}, error) {
 			user, _, _ := m.Credentials()
-
-			// Escape "=" and ",". This is mostly the same as bytes.Replace but
-			// faster because we can do both replacements in a single pass.
-			n := bytes.Count(user, []byte{'='}) + bytes.Count(user, []byte{','})
-			username := make([]byte, len(user)+(n*2))
-			w := 0
-			start := 0
-			for i := 0; i < n; i++ {
-				j := start
-				j += bytes.IndexAny(user[start:], "=,")
-				w += copy(username[w:], user[start:j])
-				switch user[j] {
-				case '=':
-					w += copy(username[w:], "=3D")
-				case ',':
-					w += copy(username[w:], "=2C")
-				}
-				start = j + 1
-			}
-			copy(username[w:], user[start:])
+			username := escapeSASLName(user)
 
 			clientFirstMessage := make([]byte, 5+len(m.Nonce())+len(username))
 			copy(clientFirstMessage, "n=")
@@ -85,7 +81,11 @@ func scram(name string, fn func() hash.Hash) Mechanism {
 			copy(clientFirstMessage[2+len(username):], ",r=")
 			copy(clientFirstMessage[5+len(username):], m.Nonce())
 
-			return true, append(getGS2Header(name, m), clientFirstMessage...), clientFirstMessage, nil
+			gs2Header, _, err := getGS2Header(name, m)
+			if err != nil {
+				return false, nil, nil, err
+			}
+			return true, append(gs2Header, clientFirstMessage...), clientFirstMessage, nil
 		},
 		Next: func(m *Negotiator, challenge []byte, data interface{}) (more bool, resp []byte, cache interface{}, err error) {
 			if challenge == nil || len(challenge) == 0 {
@@ -93,7 +93,7 @@ func scram(name string, fn func() hash.Hash) Mechanism {
 			}
 
 			if m.State()&Receiving == Receiving {
-				panic("not yet implemented")
+				return scramServerNext(name, fn, m, challenge, data)
 			}
 			return scramClientNext(name, fn, m, challenge, data)
 		},
@@ -107,7 +107,7 @@ func scramClientNext(name string, fn func() hash.Hash, m *Negotiator, challenge
 	switch state & StepMask {
 	case AuthTextSent:
 		iter := -1
-		var salt, nonce []byte
+		var salt, nonce, downgrade []byte
 		for _, field := range bytes.Split(challenge, []byte{','}) {
 			if len(field) < 3 || (len(field) >= 2 && field[1] != '=') {
 				continue
@@ -129,6 +129,8 @@ func scramClientNext(name string, fn func() hash.Hash, m *Negotiator, challenge
 				}
 			case 'r':
 				nonce = field[2:]
+			case 'd':
+				downgrade = field[2:]
 			case 'm':
 				// RFC 5802:
 				// m: This attribute is reserved for future extensibility.  In this
@@ -153,30 +155,39 @@ func scramClientNext(name string, fn func() hash.Hash, m *Negotiator, challenge
 		case salt == nil:
 			err = errors.New("Server sent empty salt")
 			return
+		// Servers that do not support XEP-0474 do not send the hash, so a missing
+		// hash is not an error.
+		case downgrade != nil && m.ssdp && !hmac.Equal(downgrade, ssdpHash(fn, m.remoteMechanisms, m.cbTypes)):
+			err = ErrDowngrade
+			return
 		}
 
-		gs2Header := getGS2Header(name, m)
-		tlsState := m.TLSState()
-		var channelBinding []byte
-		if tlsState != nil && strings.HasSuffix(name, "-PLUS") {
-			channelBinding = make(
-				[]byte,
-				2+base64.StdEncoding.EncodedLen(len(gs2Header)+len(tlsState.TLSUnique)),
-			)
-			base64.StdEncoding.Encode(channelBinding[2:], append(gs2Header, tlsState.TLSUnique...))
-			channelBinding[0] = 'c'
-			channelBinding[1] = '='
-		} else {
-			channelBinding = make(
-				[]byte,
-				2+base64.StdEncoding.EncodedLen(len(gs2Header)),
-			)
-			base64.StdEncoding.Encode(channelBinding[2:], gs2Header)
-			channelBinding[0] = 'c'
-			channelBinding[1] = '='
-		}
-		clientFinalMessageWithoutProof := append(channelBinding, []byte(",r=")...)
+		var gs2Header, cbData []byte
+		var cbType string
+		gs2Header, cbType, err = getGS2Header(name, m)
+		if err != nil {
+			return
+		}
+		if cbType != "" {
+			if cbData, err = channelBindingData(m, cbType); err != nil {
+				return
+			}
+		}
+		clientFinalMessageWithoutProof := scramChannelBinding(gs2Header, cbData)
+		clientFinalMessageWithoutProof = append(clientFinalMessageWithoutProof, []byte(",r=")...)
 		clientFinalMessageWithoutProof = append(clientFinalMessageWithoutProof, nonce...)
+		if m.secondFactor != nil {
+			var code []byte
+			if code, err = m.secondFactor(m); err != nil {
+				return
+			}
+			if bytes.IndexByte(code, ',') >= 0 {
+				err = errors.New("Second factor must not contain a comma")
+				return
+			}
+			clientFinalMessageWithoutProof = append(clientFinalMessageWithoutProof, ",t="...)
+			clientFinalMessageWithoutProof = append(clientFinalMessageWithoutProof, code...)
+		}
 
 		clientFirstMessage := data.([]byte)
 		authMessage := append(clientFirstMessage, ',')
@@ -185,27 +196,7 @@ func scramClientNext(name string, fn func() hash.Hash, m *Negotiator, challenge
 		authMessage = append(authMessage, clientFinalMessageWithoutProof...)
 
 		saltedPassword := pbkdf2.Key(password, salt, iter, fn().Size(), fn)
-
-		h := hmac.New(fn, saltedPassword)
-		h.Write(serverKeyInput)
-		serverKey := h.Sum(nil)
-		h.Reset()
-
-		h.Write(clientKeyInput)
-		clientKey := h.Sum(nil)
-
-		h = hmac.New(fn, serverKey)
-		h.Write(authMessage)
-		serverSignature := h.Sum(nil)
-
-		h = fn()
-		h.Write(clientKey)
-		storedKey := h.Sum(nil)
-		h = hmac.New(fn, storedKey)
-		h.Write(authMessage)
-		clientSignature := h.Sum(nil)
-		clientProof := make([]byte, len(clientKey))
-		xorBytes(clientProof, clientKey, clientSignature)
+		clientProof, serverSignature := scramProof(fn, saltedPassword, authMessage)
 
 		encodedClientProof := make([]byte, base64.StdEncoding.EncodedLen(len(clientProof)))
 		base64.StdEncoding.Encode(encodedClientProof, clientProof)
@@ -225,3 +216,250 @@ func scramClientNext(name string, fn func() hash.Hash, m *Negotiator, challenge
 	err = ErrInvalidState
 	return
 }
+
+// scramChannelBinding returns the channel-binding attribute of the client-final
+// message: "c=" followed by the base64 encoding of the GS2 header and the
+// channel binding data (if any).
+func scramChannelBinding(gs2Header, cbData []byte) []byte {
+	input := make([]byte, 0, len(gs2Header)+len(cbData))
+	input = append(input, gs2Header...)
+	input = append(input, cbData...)
+
+	channelBinding := make([]byte, 2+base64.StdEncoding.EncodedLen(len(input)))
+	channelBinding[0] = 'c'
+	channelBinding[1] = '='
+	base64.StdEncoding.Encode(channelBinding[2:], input)
+	return channelBinding
+}
+
+// scramKeys computes the ClientKey, StoredKey and ServerKey of RFC 5802 from
+// the salted password.
+func scramKeys(fn func() hash.Hash, saltedPassword []byte) (clientKey, storedKey, serverKey []byte) {
+	h := hmac.New(fn, saltedPassword)
+	h.Write(serverKeyInput)
+	serverKey = h.Sum(nil)
+	h.Reset()
+
+	h.Write(clientKeyInput)
+	clientKey = h.Sum(nil)
+
+	h = fn()
+	h.Write(clientKey)
+	storedKey = h.Sum(nil)
+	return clientKey, storedKey, serverKey
+}
+
+// scramSignature computes the HMAC of the auth message using key, which is the
+// ClientSignature when key is the StoredKey and the ServerSignature when key is
+// the ServerKey.
+func scramSignature(fn func() hash.Hash, key, authMessage []byte) []byte {
+	h := hmac.New(fn, key)
+	h.Write(authMessage)
+	return h.Sum(nil)
+}
+
+// scramProof computes the ClientProof and ServerSignature of RFC 5802 from the
+// salted password and the auth message.
+func scramProof(fn func() hash.Hash, saltedPassword, authMessage []byte) (clientProof, serverSignature []byte) {
+	clientKey, storedKey, serverKey := scramKeys(fn, saltedPassword)
+	clientSignature := scramSignature(fn, storedKey, authMessage)
+	clientProof = make([]byte, len(clientKey))
+	xorBytes(clientProof, clientKey, clientSignature)
+	return clientProof, scramSignature(fn, serverKey, authMessage)
+}
+
+// scramMockSalt returns the salt sent to clients that try to log in as a user
+// that does not exist.
+// It is the same every time the user tries to log in so that the user cannot be
+// told apart from one that does exist.
+func scramMockSalt(name string, username []byte) []byte {
+	h := hmac.New(sha256.New, scramMockKey)
+	h.Write([]byte(name))
+	h.Write([]byte{0})
+	h.Write(username)
+	return h.Sum(nil)[:scramSaltLen]
+}
+
+// ssdpHash returns the base64 encoded hash of the mechanism and channel binding
+// type lists sent in the d attribute defined by XEP-0474.
+func ssdpHash(fn func() hash.Hash, mechanisms, cbTypes []string) []byte {
+	mechanisms = append([]string(nil), mechanisms...)
+	sort.Strings(mechanisms)
+	cbTypes = append([]string(nil), cbTypes...)
+	sort.Strings(cbTypes)
+
+	h := fn()
+	h.Write([]byte(strings.Join(mechanisms, ",")))
+	h.Write([]byte{'|'})
+	h.Write([]byte(strings.Join(cbTypes, ",")))
+	sum := h.Sum(nil)
+
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(sum)))
+	base64.StdEncoding.Encode(encoded, sum)
+	return encoded
+}
+
+// scramServerState is cached by servers between the client-first and
+// client-final messages.
+type scramServerState struct {
+	header          gs2Header
+	username        []byte
+	clientFirstBare []byte
+	serverFirst     []byte
+	nonce           []byte
+
+	// credential is nil if the user does not exist.
+	credential *ScramCredential
+}
+
+func scramServerNext(name string, fn func() hash.Hash, m *Negotiator, challenge []byte, data interface{}) (more bool, resp []byte, cache interface{}, err error) {
+	switch m.State() & StepMask {
+	case AuthTextSent:
+		header, bare, err := parseGS2Header(challenge)
+		if err != nil {
+			return false, nil, nil, err
+		}
+		if err = checkGS2Header(name, m, header); err != nil {
+			return false, nil, nil, err
+		}
+		if header.flag == 'p' && !serverAcceptsChannelBinding(m, header.cbType) {
+			return false, nil, nil, ErrChannelBinding
+		}
+
+		// client-first-message-bare = [reserved-mext ","] username "," nonce ["," extensions]
+		fields := bytes.Split(bare, []byte{','})
+		if len(fields) < 2 || len(fields[0]) > 0 && fields[0][0] == 'm' {
+			return false, nil, nil, errors.New("Client sent reserved attribute `m'")
+		}
+		if !bytes.HasPrefix(fields[0], []byte("n=")) || !bytes.HasPrefix(fields[1], []byte("r=")) || len(fields[1]) == 2 {
+			return false, nil, nil, ErrInvalidChallenge
+		}
+		username, err := unescapeSASLName(fields[0][2:])
+		if err != nil {
+			return false, nil, nil, err
+		}
+
+		// Users that do not exist are sent a made up salt and fail when the proof
+		// is checked so that they cannot be told apart from users that do (RFC
+		// 5802 §5.1).
+		credentialName := strings.TrimSuffix(name, "-PLUS")
+		var cred *ScramCredential
+		if m.scramCredentials != nil {
+			if cred, err = m.scramCredentials(m, credentialName, username); err != nil {
+				return false, nil, nil, err
+			}
+		}
+		salt, iter := scramMockSalt(credentialName, username), scramIterations
+		if cred != nil {
+			salt, iter = cred.Salt, cred.Iterations
+		}
+		nonce := append(append([]byte{}, fields[1][2:]...), m.Nonce()...)
+
+		serverFirst := append([]byte("r="), nonce...)
+		serverFirst = append(serverFirst, ",s="...)
+		serverFirst = append(serverFirst, base64.StdEncoding.EncodeToString(salt)...)
+		serverFirst = append(serverFirst, ",i="...)
+		serverFirst = strconv.AppendInt(serverFirst, int64(iter), 10)
+		if m.ssdp {
+			serverFirst = append(serverFirst, ",d="...)
+			serverFirst = append(serverFirst, ssdpHash(fn, m.advertised, serverChannelBindingTypes(m))...)
+		}
+
+		return true, serverFirst, &scramServerState{
+			header:          header,
+			username:        username,
+			clientFirstBare: bare,
+			serverFirst:     serverFirst,
+			nonce:           nonce,
+			credential:      cred,
+		}, nil
+	case ResponseSent:
+		state, ok := data.(*scramServerState)
+		if !ok {
+			return false, nil, nil, ErrInvalidState
+		}
+
+		// client-final-message = client-final-message-without-proof "," proof
+		idx := bytes.LastIndex(challenge, []byte(",p="))
+		if idx < 0 {
+			return false, nil, nil, ErrInvalidChallenge
+		}
+		withoutProof := challenge[:idx]
+		proof, err := base64.StdEncoding.DecodeString(string(challenge[idx+3:]))
+		if err != nil {
+			return false, nil, nil, ErrInvalidChallenge
+		}
+
+		fields := bytes.Split(withoutProof, []byte{','})
+		if len(fields) < 2 || !bytes.HasPrefix(fields[0], []byte("c=")) || !bytes.HasPrefix(fields[1], []byte("r=")) {
+			return false, nil, nil, ErrInvalidChallenge
+		}
+		var cbData []byte
+		if state.header.flag == 'p' {
+			if cbData, err = channelBindingData(m, state.header.cbType); err != nil {
+				return false, nil, nil, err
+			}
+		}
+		if !hmac.Equal(fields[0], scramChannelBinding(state.header.raw, cbData)) {
+			// Either the channel binding data did not match (for example because
+			// of a TLS terminating proxy) or the GS2 header was modified.
+			return false, nil, nil, ErrAuthn
+		}
+		if !bytes.Equal(fields[1][2:], state.nonce) {
+			return false, nil, nil, ErrInvalidChallenge
+		}
+		var code []byte
+		for _, field := range fields[2:] {
+			if bytes.HasPrefix(field, []byte("t=")) {
+				code = field[2:]
+			}
+		}
+
+		authMessage := append([]byte{}, state.clientFirstBare...)
+		authMessage = append(authMessage, ',')
+		authMessage = append(authMessage, state.serverFirst...)
+		authMessage = append(authMessage, ',')
+		authMessage = append(authMessage, withoutProof...)
+
+		// The client key is recovered from the proof and must hash to the stored
+		// key.
+		cred := state.credential
+		if cred == nil || len(proof) != len(cred.StoredKey) {
+			return false, nil, nil, ErrAuthn
+		}
+		clientKey := make([]byte, len(proof))
+		xorBytes(clientKey, proof, scramSignature(fn, cred.StoredKey, authMessage))
+		h := fn()
+		h.Write(clientKey)
+		if !hmac.Equal(h.Sum(nil), cred.StoredKey) {
+			return false, nil, nil, ErrAuthn
+		}
+		serverSignature := scramSignature(fn, cred.ServerKey, authMessage)
+
+		username, identity := state.username, state.header.identity
+		if m.verifyFactor != nil {
+			if code == nil {
+				return false, nil, nil, ErrAuthn
+			}
+			ok, err := m.verifyFactor(m, username, code)
+			if err != nil {
+				return false, nil, nil, err
+			}
+			if !ok {
+				return false, nil, nil, ErrAuthn
+			}
+		}
+		if !m.Permissions(Credentials(func() (Username, Password, Identity []byte) {
+			return username, nil, identity
+		})) {
+			return false, nil, nil, ErrAuthn
+		}
+
+		serverFinal := make([]byte, 2+base64.StdEncoding.EncodedLen(len(serverSignature)))
+		serverFinal[0] = 'v'
+		serverFinal[1] = '='
+		base64.StdEncoding.Encode(serverFinal[2:], serverSignature)
+		return false, serverFinal, nil, nil
+	}
+	return false, nil, nil, ErrTooManySteps
+}
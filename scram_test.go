@@ -0,0 +1,408 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+// scramCredentials looks up the credentials of the user "user", whose password
+// is "pencil".
+func scramCredentials(_ *Negotiator, mechanism string, username []byte) (*ScramCredential, error) {
+	if string(username) != "user" {
+		return nil, nil
+	}
+	fn := sha1.New
+	if mechanism == "SCRAM-SHA-256" {
+		fn = sha256.New
+	}
+	cred := NewScramCredential(fn, []byte("pencil"), []byte("NaCl"), scramIterations)
+	return &cred, nil
+}
+
+// vectorCredentials returns a ScramCredentials function for the password
+// "pencil", the base64 encoded salt, and 4096 iterations used by the test
+// vectors in RFC 5802 and RFC 7677.
+func vectorCredentials(salt string) func(*Negotiator, string, []byte) (*ScramCredential, error) {
+	return func(_ *Negotiator, mechanism string, _ []byte) (*ScramCredential, error) {
+		s, err := base64.StdEncoding.DecodeString(salt)
+		if err != nil {
+			return nil, err
+		}
+		fn := sha1.New
+		if mechanism == "SCRAM-SHA-256" {
+			fn = sha256.New
+		}
+		cred := NewScramCredential(fn, []byte("pencil"), s, 4096)
+		return &cred, nil
+	}
+}
+
+// userCredentials returns a Credentials option for the given username,
+// password, and identity.
+func userCredentials(user, pass, identity string) Option {
+	return Credentials(func() ([]byte, []byte, []byte) {
+		return []byte(user), []byte(pass), []byte(identity)
+	})
+}
+
+// testScramPair negotiates between a client and a server that looks up
+// credentials with scramCredentials and reports any unexpected errors.
+// If perm is nil the server accepts any user.
+func testScramPair(t *testing.T, mechanism Mechanism, perm func(*Negotiator) bool, clientOpts, serverOpts []Option, clientErr, serverErr error) {
+	if perm == nil {
+		perm = acceptAll
+	}
+	serverOpts = append(serverOpts[:len(serverOpts):len(serverOpts)], ScramCredentials(scramCredentials))
+	gotClient, gotServer := stepPair(NewClient(mechanism, clientOpts...), NewServer(mechanism, perm, serverOpts...))
+	if gotClient != clientErr {
+		t.Errorf("Unexpected client error: want=%v, got=%v", clientErr, gotClient)
+	}
+	if gotServer != serverErr {
+		t.Errorf("Unexpected server error: want=%v, got=%v", serverErr, gotServer)
+	}
+}
+
+// errUnfinished is returned by stepPair for the side that still expected more
+// steps when the other one finished.
+var errUnfinished = errors.New("Negotiation did not finish")
+
+// stepPair steps a client and server created for a client-first mechanism
+// until one of them errors or the negotiation completes.
+// Both sides must finish with more == false on the same step.
+func stepPair(client, server *Negotiator) (clientErr, serverErr error) {
+	more, resp, err := client.Step(nil)
+	if err != nil {
+		return err, nil
+	}
+	for {
+		serverMore, challenge, err := server.Step(resp)
+		if err != nil {
+			return nil, err
+		}
+		if !more {
+			if serverMore {
+				return nil, errUnfinished
+			}
+			return nil, nil
+		}
+		more, resp, err = client.Step(challenge)
+		if err != nil {
+			return err, nil
+		}
+		if !serverMore {
+			if more {
+				return errUnfinished, nil
+			}
+			return nil, nil
+		}
+	}
+}
+
+var scramTLS = tls.ConnectionState{TLSUnique: []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}}
+
+func TestScramServer(t *testing.T) {
+	serverMechanisms := []string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256", "SCRAM-SHA-1-PLUS", "SCRAM-SHA-1"}
+	for _, tc := range [...]struct {
+		name       string
+		mechanism  Mechanism
+		user, pass string
+		identity   string
+		clientOpts []Option
+		serverOpts []Option
+		perm       func(*Negotiator) bool
+		clientErr  error
+		serverErr  error
+	}{
+		0: {
+			name:      "SCRAM-SHA-1",
+			mechanism: ScramSha1,
+			user:      "user", pass: "pencil",
+		},
+		1: {
+			name:      "SCRAM-SHA-256",
+			mechanism: ScramSha256,
+			user:      "user", pass: "pencil",
+		},
+		2: {
+			name:      "SCRAM-SHA-256/WrongPassword",
+			mechanism: ScramSha256,
+			user:      "user", pass: "wrong",
+			serverErr: ErrAuthn,
+		},
+		3: {
+			name:      "SCRAM-SHA-256/UnknownUser",
+			mechanism: ScramSha256,
+			user:      "nobody", pass: "pencil",
+			serverErr: ErrAuthn,
+		},
+		4: {
+			name:      "SCRAM-SHA-256/Identity",
+			mechanism: ScramSha256,
+			user:      "user", pass: "pencil",
+			identity: "ad,=min",
+			perm: func(n *Negotiator) bool {
+				user, _, identity := n.Credentials()
+				return string(user) == "user" && string(identity) == "ad,=min"
+			},
+		},
+		5: {
+			name:      "SCRAM-SHA-256-PLUS",
+			mechanism: ScramSha256Plus,
+			user:      "user", pass: "pencil",
+			clientOpts: []Option{TLSState(scramTLS), RemoteMechanisms(serverMechanisms...)},
+			serverOpts: []Option{TLSState(scramTLS), AdvertisedMechanisms(serverMechanisms...)},
+		},
+		6: {
+			// A TLS terminating proxy has a different TLS session with each side.
+			name:      "SCRAM-SHA-256-PLUS/BindingMismatch",
+			mechanism: ScramSha256Plus,
+			user:      "user", pass: "pencil",
+			clientOpts: []Option{TLSState(scramTLS), RemoteMechanisms(serverMechanisms...)},
+			serverOpts: []Option{TLSState(tls.ConnectionState{TLSUnique: []byte("other")}), AdvertisedMechanisms(serverMechanisms...)},
+			serverErr:  ErrAuthn,
+		},
+		7: {
+			// The client chose not to use channel binding even though both sides
+			// support it.
+			name:      "SCRAM-SHA-256/NoBinding",
+			mechanism: ScramSha256,
+			user:      "user", pass: "pencil",
+			clientOpts: []Option{TLSState(scramTLS), RemoteMechanisms(serverMechanisms...)},
+			serverOpts: []Option{TLSState(scramTLS), AdvertisedMechanisms(serverMechanisms...)},
+		},
+		8: {
+			// A MITM stripped the -PLUS mechanisms from the list sent to the
+			// client.
+			name:      "SCRAM-SHA-256/Downgrade",
+			mechanism: ScramSha256,
+			user:      "user", pass: "pencil",
+			clientOpts: []Option{TLSState(scramTLS), RemoteMechanisms("SCRAM-SHA-256", "SCRAM-SHA-1")},
+			serverOpts: []Option{TLSState(scramTLS), AdvertisedMechanisms(serverMechanisms...)},
+			serverErr:  ErrDowngrade,
+		},
+		9: {
+			name:      "SCRAM-SHA-1/Downgrade",
+			mechanism: ScramSha1,
+			user:      "user", pass: "pencil",
+			clientOpts: []Option{TLSState(scramTLS), RemoteMechanisms("SCRAM-SHA-256", "SCRAM-SHA-1")},
+			serverOpts: []Option{TLSState(scramTLS), AdvertisedMechanisms(serverMechanisms...)},
+			serverErr:  ErrDowngrade,
+		},
+		10: {
+			// The server really does not support channel binding, so the "y" flag
+			// is expected.
+			name:      "SCRAM-SHA-256/ServerNoBinding",
+			mechanism: ScramSha256,
+			user:      "user", pass: "pencil",
+			clientOpts: []Option{TLSState(scramTLS), RemoteMechanisms("SCRAM-SHA-256", "SCRAM-SHA-1")},
+			serverOpts: []Option{TLSState(scramTLS), AdvertisedMechanisms("SCRAM-SHA-256", "SCRAM-SHA-1")},
+		},
+		11: {
+			// The server advertises -PLUS but the connection to the client is not
+			// using TLS so channel binding was never possible.
+			name:      "SCRAM-SHA-256/ServerNoTLS",
+			mechanism: ScramSha256,
+			user:      "user", pass: "pencil",
+			clientOpts: []Option{TLSState(scramTLS), RemoteMechanisms("SCRAM-SHA-256")},
+			serverOpts: []Option{AdvertisedMechanisms(serverMechanisms...)},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clientOpts := append(tc.clientOpts, userCredentials(tc.user, tc.pass, tc.identity))
+			testScramPair(t, tc.mechanism, tc.perm, clientOpts, tc.serverOpts, tc.clientErr, tc.serverErr)
+		})
+	}
+}
+
+func TestServerDowngrade(t *testing.T) {
+	s := &Server{
+		Mechanisms:  []string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256"},
+		Permissions: acceptAll,
+		Options:     []Option{TLSState(scramTLS), ScramCredentials(scramCredentials)},
+	}
+
+	// The client only saw SCRAM-SHA-256 because of a MITM.
+	client := NewClient(ScramSha256, TLSState(scramTLS), RemoteMechanisms("SCRAM-SHA-256"), Credentials(func() ([]byte, []byte, []byte) {
+		return []byte("user"), []byte("pencil"), nil
+	}))
+	_, initial, err := client.Step(nil)
+	if err != nil {
+		t.Fatalf("Unexpected client error: %v", err)
+	}
+	_, _, _, err = s.Negotiate(context.Background(), "SCRAM-SHA-256", initial)
+	if err != ErrDowngrade {
+		t.Errorf("Unexpected error: want=%v, got=%v", ErrDowngrade, err)
+	}
+}
+
+func TestScramUnknownUser(t *testing.T) {
+	salt := func(user string) string {
+		client := NewClient(ScramSha256, Credentials(func() ([]byte, []byte, []byte) {
+			return []byte(user), []byte("pencil"), nil
+		}))
+		server := NewServer(ScramSha256, acceptAll, ScramCredentials(scramCredentials))
+		_, resp, err := client.Step(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, challenge, err := server.Step(resp)
+		if err != nil {
+			t.Fatalf("Unexpected error before the proof was checked: %v", err)
+		}
+		_, resp, err = client.Step(challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err = server.Step(resp); err != ErrAuthn {
+			t.Errorf("Unexpected error for user %q: want=%v, got=%v", user, ErrAuthn, err)
+		}
+		for _, field := range bytes.Split(challenge, []byte{','}) {
+			if bytes.HasPrefix(field, []byte("s=")) {
+				return string(field[2:])
+			}
+		}
+		t.Fatalf("No salt in server-first message %q", challenge)
+		return ""
+	}
+
+	// Unknown users always get the same salt, but a different one from other
+	// unknown users.
+	if a, b := salt("romeo"), salt("romeo"); a != b {
+		t.Errorf("Salt changed between attempts: %s, %s", a, b)
+	}
+	if a, b := salt("romeo"), salt("mercutio"); a == b {
+		t.Errorf("Unknown users share a salt: %s", a)
+	}
+}
+
+func TestDowngradeProtection(t *testing.T) {
+	tlsClient, tlsServer := tlsPair(t, versionTLS13)
+	cert := tlsClient.PeerCertificates[0]
+	serverMechanisms := []string{"SCRAM-SHA-256-PLUS", "SCRAM-SHA-256", "PLAIN"}
+	for _, tc := range [...]struct {
+		name       string
+		clientOpts []Option
+		serverOpts []Option
+		clientErr  error
+	}{
+		{
+			name:       "Match",
+			clientOpts: []Option{TLSState(tlsClient), RemoteMechanisms("PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-256-PLUS"), ChannelBindingTypes("tls-exporter", "tls-server-end-point"), DowngradeProtection()},
+			serverOpts: []Option{TLSState(tlsServer), ServerCertificate(cert), AdvertisedMechanisms(serverMechanisms...), ChannelBindingTypes("tls-server-end-point", "tls-exporter"), DowngradeProtection()},
+		},
+		{
+			// Types that the server can not verify are not part of the hash.
+			name:       "UnverifiableChannelBinding",
+			clientOpts: []Option{TLSState(tlsClient), RemoteMechanisms(serverMechanisms...), ChannelBindingTypes("tls-exporter"), DowngradeProtection()},
+			serverOpts: []Option{TLSState(tlsServer), AdvertisedMechanisms(serverMechanisms...), ChannelBindingTypes("tls-exporter", "tls-server-end-point", "tls-unique"), DowngradeProtection()},
+		},
+		{
+			name:       "StrippedMechanism",
+			clientOpts: []Option{RemoteMechanisms("PLAIN", "SCRAM-SHA-256"), DowngradeProtection()},
+			serverOpts: []Option{AdvertisedMechanisms(serverMechanisms...), DowngradeProtection()},
+			clientErr:  ErrDowngrade,
+		},
+		{
+			name:       "StrippedChannelBinding",
+			clientOpts: []Option{TLSState(tlsClient), RemoteMechanisms(serverMechanisms...), ChannelBindingTypes("tls-server-end-point"), DowngradeProtection()},
+			serverOpts: []Option{TLSState(tlsServer), ServerCertificate(cert), AdvertisedMechanisms(serverMechanisms...), ChannelBindingTypes("tls-exporter", "tls-server-end-point"), DowngradeProtection()},
+			clientErr:  ErrDowngrade,
+		},
+		{
+			name:       "ServerUnsupported",
+			clientOpts: []Option{RemoteMechanisms("PLAIN", "SCRAM-SHA-256"), DowngradeProtection()},
+			serverOpts: []Option{AdvertisedMechanisms(serverMechanisms...)},
+		},
+		{
+			name:       "ClientUnsupported",
+			clientOpts: []Option{RemoteMechanisms("PLAIN", "SCRAM-SHA-256")},
+			serverOpts: []Option{AdvertisedMechanisms(serverMechanisms...), ChannelBindingTypes("tls-exporter"), DowngradeProtection()},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			clientOpts := append(tc.clientOpts, userCredentials("user", "pencil", ""))
+			testScramPair(t, ScramSha256, nil, clientOpts, tc.serverOpts, tc.clientErr, nil)
+		})
+	}
+}
+
+func TestSSDPHash(t *testing.T) {
+	a := ssdpHash(sha256.New, []string{"SCRAM-SHA-1", "PLAIN"}, []string{"tls-unique", "tls-exporter"})
+	b := ssdpHash(sha256.New, []string{"PLAIN", "SCRAM-SHA-1"}, []string{"tls-exporter", "tls-unique"})
+	if !bytes.Equal(a, b) {
+		t.Errorf("Hash depends on the order of the lists: %s, %s", a, b)
+	}
+
+	sum := sha256.Sum256([]byte("PLAIN,SCRAM-SHA-1|tls-exporter,tls-unique"))
+	if want := base64.StdEncoding.EncodeToString(sum[:]); string(a) != want {
+		t.Errorf("Unexpected hash: want=%s, got=%s", want, a)
+	}
+
+	// Moving a mechanism into the channel binding list must change the hash.
+	c := ssdpHash(sha256.New, []string{"PLAIN"}, []string{"SCRAM-SHA-1", "tls-exporter", "tls-unique"})
+	if bytes.Equal(a, c) {
+		t.Error("Hash does not separate the lists")
+	}
+}
+
+func TestScramSecondFactor(t *testing.T) {
+	errBackend := errors.New("backend unavailable")
+	verify := func(_ *Negotiator, username, code []byte) (bool, error) {
+		if string(code) == "unavailable" {
+			return false, errBackend
+		}
+		return string(username) == "user" && string(code) == "287082", nil
+	}
+	for _, tc := range [...]struct {
+		name      string
+		code      string
+		noCode    bool
+		noVerify  bool
+		pass      string
+		clientErr error
+		serverErr error
+	}{
+		{name: "Valid", code: "287082", pass: "pencil"},
+		{name: "Invalid", code: "000000", pass: "pencil", serverErr: ErrAuthn},
+		{name: "Missing", noCode: true, pass: "pencil", serverErr: ErrAuthn},
+		{name: "WrongPassword", code: "287082", pass: "wrong", serverErr: ErrAuthn},
+		{name: "NotRequired", code: "287082", pass: "pencil", noVerify: true},
+		{name: "VerifierError", code: "unavailable", pass: "pencil", serverErr: errBackend},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			code := tc.code
+			clientOpts := []Option{userCredentials("user", tc.pass, "")}
+			if !tc.noCode {
+				clientOpts = append(clientOpts, SecondFactor(func(*Negotiator) ([]byte, error) {
+					return []byte(code), nil
+				}))
+			}
+			var serverOpts []Option
+			if !tc.noVerify {
+				serverOpts = append(serverOpts, VerifySecondFactor(verify))
+			}
+			testScramPair(t, ScramSha256, nil, clientOpts, serverOpts, tc.clientErr, tc.serverErr)
+		})
+	}
+}
+
+func TestScramSecondFactorComma(t *testing.T) {
+	client := NewClient(ScramSha256, SecondFactor(func(*Negotiator) ([]byte, error) {
+		return []byte("12,34"), nil
+	}))
+	server := NewServer(ScramSha256, acceptAll)
+	clientErr, _ := stepPair(client, server)
+	if clientErr == nil {
+		t.Error("Expected an error when the second factor contains a comma")
+	}
+}
@@ -0,0 +1,122 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"context"
+)
+
+// builtin is used by servers that do not set a registry.
+// It must not be modified.
+var builtin = NewRegistry()
+
+// A Server offers several mechanisms to clients and creates a Negotiator for
+// whichever one the client selects.
+// The permissions function and options are shared by all mechanisms, so a
+// single credential backend (eg. the Secret option) can be used for all of
+// them.
+type Server struct {
+	// Registry is used to look up mechanisms by name.
+	// If it is nil the builtin mechanisms are used.
+	Registry *Registry
+
+	// Mechanisms is the list of mechanism names that may be offered, in order.
+	// If it is nil, every mechanism in the registry is offered in the order
+	// of the policy's preference.
+	Mechanisms []string
+
+	// Policy filters the mechanisms that are offered, for example to avoid
+	// advertising PLAIN on connections without TLS.
+	Policy Policy
+
+	// Permissions and Options are passed to NewServer for every negotiation.
+	Permissions func(*Negotiator) bool
+	Options     []Option
+}
+
+func (s *Server) registry() *Registry {
+	if s.Registry != nil {
+		return s.Registry
+	}
+	return builtin
+}
+
+// Advertise returns the names of the mechanisms that should be advertised to
+// clients, taking into account the TLS state from the options and the policy.
+// Mechanisms with the ClientOnly property are never advertised.
+func (s *Server) Advertise() []string {
+	probe := &Negotiator{}
+	getOpts(probe, s.Options...)
+	tlsState := probe.TLSState()
+	r := s.registry()
+
+	var names []string
+	if s.Mechanisms == nil {
+		for _, m := range s.Policy.sort(r.Mechanisms(), tlsState) {
+			if m.Properties&ClientOnly == 0 {
+				names = append(names, m.Name)
+			}
+		}
+		return names
+	}
+	for _, name := range s.Mechanisms {
+		m, ok := r.Lookup(name)
+		if ok && m.Properties&ClientOnly == 0 && s.Policy.Allowed(m, tlsState) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ChannelBindingTypes returns the channel binding types that should be
+// advertised to clients, for example using XEP-0440.
+// They are the types set with the ChannelBindingTypes option that can be
+// verified using the TLS state and certificate from the options.
+func (s *Server) ChannelBindingTypes() []string {
+	probe := &Negotiator{}
+	getOpts(probe, s.Options...)
+	return serverChannelBindingTypes(probe)
+}
+
+// Negotiate creates a server Negotiator for the mechanism selected by the
+// client and performs the first step.
+// Initial is the initial response sent by the client along with its selection,
+// or nil if it did not send one.
+//
+// The returned values of more and challenge are the same as for Step: if more
+// is true challenge should be sent to the client and the negotiation continued
+// with the returned Negotiator (for example using Run), otherwise the
+// negotiation succeeded and challenge is any additional data to send with the
+// success message.
+// If the client did not send an initial response for a client-first mechanism,
+// the challenge is empty to request one, and an empty response from the client
+// is then passed to the mechanism instead of being requested again.
+//
+// If the mechanism was not advertised ErrNoMechanism is returned, and if the
+// client sent an initial response to a server-first mechanism
+// ErrInvalidChallenge is returned.
+func (s *Server) Negotiate(ctx context.Context, name string, initial []byte) (n *Negotiator, more bool, challenge []byte, err error) {
+	advertised := s.Advertise()
+	if !contains(advertised, name) {
+		return nil, false, nil, ErrNoMechanism
+	}
+
+	// Let the mechanism know what was advertised so that it can detect
+	// downgrade attacks.
+	opts := append(s.Options[:len(s.Options):len(s.Options)], AdvertisedMechanisms(advertised...))
+	n, err = s.registry().NewServer(name, s.Permissions, opts...)
+	if err != nil {
+		return nil, false, nil, err
+	}
+
+	if initial == nil && !n.mechanism.ServerFirst {
+		// Remember that the initial response was requested so that Run does not
+		// ask for it again.
+		n.requested = true
+		return n, true, []byte{}, nil
+	}
+	more, challenge, err = n.StepContext(ctx, initial)
+	return n, more, challenge, err
+}
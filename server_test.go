@@ -0,0 +1,130 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"context"
+	"crypto/tls"
+	"reflect"
+	"testing"
+)
+
+func TestServerAdvertise(t *testing.T) {
+	s := &Server{}
+	want := []string{"HT-SHA-256-NONE", "SCRAM-SHA-256", "SCRAM-SHA-1", "CRAM-MD5"}
+	if got := s.Advertise(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected mechanisms without TLS: want=%v, got=%v", want, got)
+	}
+
+	s.Options = []Option{TLSState(tls.ConnectionState{TLSUnique: []byte{0, 1, 2, 3, 4}})}
+	want = []string{
+		"HT-SHA-256-EXPR", "HT-SHA-256-UNIQ", "HT-SHA-256-ENDP",
+		"SCRAM-SHA-256-PLUS", "SCRAM-SHA-1-PLUS", "HT-SHA-256-NONE",
+		"SCRAM-SHA-256", "SCRAM-SHA-1", "CRAM-MD5", "PLAIN",
+	}
+	if got := s.Advertise(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected mechanisms with TLS: want=%v, got=%v", want, got)
+	}
+
+	s.Mechanisms = []string{"PLAIN", "X-UNKNOWN", "SCRAM-SHA-1-PLUS"}
+	s.Policy.RequireChannelBinding = true
+	want = []string{"SCRAM-SHA-1-PLUS"}
+	if got := s.Advertise(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected mechanisms with configured list: want=%v, got=%v", want, got)
+	}
+
+	// Mechanisms that only work on clients are never advertised.
+	s.Registry = NewRegistry()
+	s.Registry.Register("DIGEST-MD5", func() Mechanism {
+		return DigestMD5("xmpp/example.net")
+	})
+	s.Policy = Policy{}
+	for _, mechanisms := range [][]string{nil, {"DIGEST-MD5", "PLAIN"}} {
+		s.Mechanisms = mechanisms
+		for _, name := range s.Advertise() {
+			if name == "DIGEST-MD5" {
+				t.Errorf("Client only mechanism advertised with %v", mechanisms)
+			}
+		}
+	}
+}
+
+func TestServerNegotiate(t *testing.T) {
+	s := &Server{
+		Permissions: acceptAll,
+		Options: []Option{
+			TLSState(tls.ConnectionState{TLSUnique: []byte{0, 1, 2, 3, 4}}),
+			Secret(cramSecret),
+		},
+	}
+	ctx := context.Background()
+
+	if _, _, _, err := s.Negotiate(ctx, "X-UNKNOWN", nil); err != ErrNoMechanism {
+		t.Errorf("Expected ErrNoMechanism for unknown mechanism, got %v", err)
+	}
+
+	n, more, challenge, err := s.Negotiate(ctx, "PLAIN", plainResp)
+	if err != nil || more || challenge != nil {
+		t.Errorf("Unexpected result for PLAIN with initial response: more=%v challenge=%q err=%v", more, challenge, err)
+	}
+	if n.State()&Receiving != Receiving {
+		t.Errorf("Expected a server negotiator")
+	}
+
+	n, more, challenge, err = s.Negotiate(ctx, "PLAIN", nil)
+	if err != nil || !more || challenge == nil || len(challenge) != 0 {
+		t.Fatalf("Expected empty challenge without initial response: more=%v challenge=%q err=%v", more, challenge, err)
+	}
+	if more, _, err = n.Step(plainResp); err != nil || more {
+		t.Errorf("Unexpected result after requesting initial response: more=%v err=%v", more, err)
+	}
+
+	if _, _, _, err = s.Negotiate(ctx, "CRAM-MD5", []byte("tim")); err != ErrInvalidChallenge {
+		t.Errorf("Expected ErrInvalidChallenge for initial response to server-first mechanism, got %v", err)
+	}
+
+	n, more, challenge, err = s.Negotiate(ctx, "CRAM-MD5", nil)
+	if err != nil || !more || len(challenge) == 0 {
+		t.Fatalf("Unexpected result for CRAM-MD5: more=%v challenge=%q err=%v", more, challenge, err)
+	}
+	client := NewClient(CramMD5, Credentials(func() ([]byte, []byte, []byte) {
+		return []byte("tim"), []byte("tanstaaftanstaaf"), nil
+	}))
+	_, resp, err := client.Step(challenge)
+	if err != nil {
+		t.Fatalf("Unexpected client error: %v", err)
+	}
+	if more, _, err = n.Step(resp); err != nil || more {
+		t.Errorf("Unexpected result for CRAM-MD5 response: more=%v err=%v", more, err)
+	}
+}
+
+func TestServerChannelBindingTypes(t *testing.T) {
+	tlsClient, tlsServer := tlsPair(t, versionTLS13)
+	s := &Server{}
+	if got := s.ChannelBindingTypes(); got != nil {
+		t.Errorf("Unexpected types without the option: %v", got)
+	}
+
+	types := ChannelBindingTypes("tls-server-end-point", "tls-unique", "tls-exporter")
+	s.Options = []Option{types}
+	if got := s.ChannelBindingTypes(); got != nil {
+		t.Errorf("Unexpected types without TLS: %v", got)
+	}
+
+	// tls-unique is not defined for TLS 1.3 and tls-server-end-point can not be
+	// computed without the servers certificate.
+	s.Options = []Option{types, TLSState(tlsServer)}
+	want := []string{"tls-exporter"}
+	if got := s.ChannelBindingTypes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected types without a certificate: want=%v, got=%v", want, got)
+	}
+
+	s.Options = append(s.Options, ServerCertificate(tlsClient.PeerCertificates[0]))
+	want = []string{"tls-server-end-point", "tls-exporter"}
+	if got := s.ChannelBindingTypes(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected types with a certificate: want=%v, got=%v", want, got)
+	}
+}
@@ -0,0 +1,65 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+// A Session holds the state of a single negotiation attempt.
+// Unlike the cache that is passed between the Start and Next functions of a
+// Mechanism, a Session is a concrete type owned by the mechanism so its state
+// can be accessed without type assertions.
+type Session interface {
+	// Step is called once for every step of the negotiation.
+	// On the side that goes first the challenge for the first step is nil.
+	Step(n *Negotiator, challenge []byte) (more bool, resp []byte, err error)
+
+	// Close releases any resources held by the session.
+	// It is called exactly once when the negotiation completes or fails, or
+	// when the negotiator is reset or closed part way through.
+	Close() error
+}
+
+// SessionMechanism returns a Mechanism that creates a new Session for every
+// negotiation attempt using newSession and then calls its Step method.
+// This lets mechanisms be written against the Session interface while still
+// being usable anywhere a Mechanism is accepted.
+// Server-first mechanisms should set ServerFirst on the returned Mechanism, and
+// its security properties should be set with Properties.
+func SessionMechanism(name string, newSession func(n *Negotiator) (Session, error)) Mechanism {
+	return Mechanism{
+		Name: name,
+		Start: func(n *Negotiator) (bool, []byte, interface{}, error) {
+			s, err := newSession(n)
+			if err != nil {
+				return false, nil, nil, err
+			}
+			return sessionStep(n, s, nil)
+		},
+		Next: func(n *Negotiator, challenge []byte, data interface{}) (bool, []byte, interface{}, error) {
+			// If the first step was not handled by Start (eg. on servers or on
+			// clients for server-first mechanisms) we won't have a session yet.
+			s, _ := data.(Session)
+			if s == nil {
+				var err error
+				s, err = newSession(n)
+				if err != nil {
+					return false, nil, nil, err
+				}
+			}
+			return sessionStep(n, s, challenge)
+		},
+		Close: func(n *Negotiator, data interface{}) error {
+			if s, ok := data.(Session); ok {
+				return s.Close()
+			}
+			return nil
+		},
+	}
+}
+
+// sessionStep always returns the session as the cache so that the negotiator
+// can close it when the negotiation ends.
+func sessionStep(n *Negotiator, s Session, challenge []byte) (more bool, resp []byte, cache interface{}, err error) {
+	more, resp, err = s.Step(n, challenge)
+	return more, resp, s, err
+}
@@ -0,0 +1,153 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+)
+
+// countSession finishes after a fixed number of steps and tracks how many
+// times it was closed.
+type countSession struct {
+	steps  int
+	fail   bool
+	seen   int
+	closed *int
+}
+
+func (s *countSession) Step(n *Negotiator, challenge []byte) (bool, []byte, error) {
+	s.seen++
+	if s.fail && s.seen == s.steps {
+		return false, nil, errors.New("expected failure")
+	}
+	return s.seen < s.steps, []byte(strconv.Itoa(s.seen)), nil
+}
+
+func (s *countSession) Close() error {
+	*s.closed++
+	return nil
+}
+
+func TestSessionMechanism(t *testing.T) {
+	for _, tc := range [...]struct {
+		name string
+		fail bool
+	}{
+		{name: "success"},
+		{name: "failure", fail: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var created, closed int
+			m := SessionMechanism("COUNT", func(n *Negotiator) (Session, error) {
+				created++
+				return &countSession{steps: 3, fail: tc.fail, closed: &closed}, nil
+			})
+
+			for _, n := range []*Negotiator{NewClient(m), NewServer(m, acceptAll)} {
+				for i := 1; i <= 3; i++ {
+					more, resp, err := n.Step(nil)
+					switch {
+					case i == 3 && tc.fail:
+						if err == nil {
+							t.Fatalf("Expected error on final step")
+						}
+						continue
+					case err != nil:
+						t.Fatalf("Unexpected error on step %d: %v", i, err)
+					case string(resp) != strconv.Itoa(i):
+						t.Fatalf("Wrong response: want=%d, got=%s", i, resp)
+					case more != (i < 3):
+						t.Fatalf("Wrong value for more on step %d: %v", i, more)
+					}
+				}
+			}
+			if created != 2 {
+				t.Errorf("Expected one session per negotiator, got %d", created)
+			}
+			if closed != 2 {
+				t.Errorf("Expected each session to be closed once, got %d", closed)
+			}
+		})
+	}
+}
+
+func TestSessionClosedOnReset(t *testing.T) {
+	var closed int
+	m := SessionMechanism("COUNT", func(n *Negotiator) (Session, error) {
+		return &countSession{steps: 3, closed: &closed}, nil
+	})
+	n := NewClient(m)
+
+	if _, _, err := n.Step(nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	n.Reset()
+	if closed != 1 {
+		t.Fatalf("Expected Reset to close the session, got %d closes", closed)
+	}
+
+	if _, _, err := n.Step(nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := n.Close(); err != nil {
+		t.Fatalf("Unexpected error closing negotiator: %v", err)
+	}
+	if err := n.Close(); err != nil {
+		t.Fatalf("Unexpected error closing negotiator twice: %v", err)
+	}
+	if closed != 2 {
+		t.Fatalf("Expected Close to close the session once, got %d closes", closed)
+	}
+}
+
+func TestSessionClosedOnEarlyError(t *testing.T) {
+	for _, tc := range [...]struct {
+		name string
+		opts []Option
+		step func(n *Negotiator) error
+		err  error
+	}{
+		{
+			name: "Canceled",
+			step: func(n *Negotiator) error {
+				ctx, cancel := context.WithCancel(context.Background())
+				cancel()
+				_, _, err := n.StepContext(ctx, nil)
+				return err
+			},
+			err: context.Canceled,
+		},
+		{
+			name: "TooManySteps",
+			opts: []Option{MaxSteps(1)},
+			step: func(n *Negotiator) error {
+				_, _, err := n.Step(nil)
+				return err
+			},
+			err: ErrTooManySteps,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var closed int
+			m := SessionMechanism("COUNT", func(n *Negotiator) (Session, error) {
+				return &countSession{steps: 3, closed: &closed}, nil
+			})
+			n := NewClient(m, tc.opts...)
+
+			if _, _, err := n.Step(nil); err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if err := tc.step(n); err != tc.err {
+				t.Fatalf("Unexpected error: want=%v, got=%v", tc.err, err)
+			}
+			if closed != 1 {
+				t.Fatalf("Expected the session to be closed once the negotiation failed, got %d closes", closed)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+// BeginTask starts the named task after the current mechanism or task has
+// completed successfully.
+// Any resources held by the previous mechanism are released, and the state
+// machine is reset to the initial state of the task.
+//
+// Tasks are additional challenge/response exchanges that are performed after a
+// mechanism has completed successfully, such as the tasks that may follow
+// authentication in SASL2 (XEP-0388).
+// They use the Mechanism type, but are selected by the server once the main
+// mechanism has finished instead of being selected by the client up front.
+// A typical SASL2 negotiation runs the main mechanism until the server's Step
+// returns more == false, sends a continue element listing the names returned
+// by Tasks instead of a success element, and then starts the task selected by
+// the client with BeginTask.
+// The task is then stepped exactly like a mechanism.
+//
+// If the named task was not provided with the Tasks option ErrNoMechanism is
+// returned, and if the current mechanism has not completed ErrInvalidState is
+// returned.
+func (c *Negotiator) BeginTask(name string) error {
+	if !c.done {
+		return ErrInvalidState
+	}
+	for _, task := range c.tasks {
+		if task.Name != name {
+			continue
+		}
+		if err := c.release(); err != nil {
+			return err
+		}
+		if c.primary == nil {
+			primary := c.mechanism
+			c.primary = &primary
+		}
+		c.mechanism = task
+		c.restart()
+		return nil
+	}
+	return ErrNoMechanism
+}
+
+// Task returns the name of the task that is currently being performed, or an
+// empty string if the original mechanism is still in use.
+func (c *Negotiator) Task() string {
+	if c.primary == nil {
+		return ""
+	}
+	return c.mechanism.Name
+}
+
+// Tasks returns the names of the tasks that were provided with the Tasks
+// option, in order.
+// Servers can use it to build the list of tasks offered to the client.
+func (c *Negotiator) Tasks() []string {
+	names := make([]string, 0, len(c.tasks))
+	for _, task := range c.tasks {
+		names = append(names, task.Name)
+	}
+	return names
+}
+
+// InlineFeatures returns the names of the features that were set with the
+// InlineFeatures option.
+func (c *Negotiator) InlineFeatures() []string {
+	return c.inline
+}
+
+// UserAgent returns the user-agent information that was set with the UserAgent
+// option.
+func (c *Negotiator) UserAgent() (id, software, device string) {
+	return c.userAgent[0], c.userAgent[1], c.userAgent[2]
+}
@@ -0,0 +1,144 @@
+// Copyright 2016 The Mellium Contributors.
+// Use of this source code is governed by the BSD 2-clause license that can be
+// found in the LICENSE file.
+
+package sasl
+
+import (
+	"reflect"
+	"testing"
+)
+
+var pingTask = Mechanism{
+	Name: "PING",
+	Start: func(*Negotiator) (bool, []byte, interface{}, error) {
+		return true, []byte("ping"), nil, nil
+	},
+	Next: func(n *Negotiator, challenge []byte, _ interface{}) (bool, []byte, interface{}, error) {
+		want := "pong"
+		if n.State()&Receiving == Receiving {
+			want = "ping"
+		}
+		if string(challenge) != want {
+			return false, nil, nil, ErrAuthn
+		}
+		if n.State()&Receiving == Receiving {
+			return false, []byte("pong"), nil, nil
+		}
+		return false, nil, nil, nil
+	},
+}
+
+func TestTasks(t *testing.T) {
+	client := NewClient(ScramSha256, Tasks(pingTask), Credentials(func() ([]byte, []byte, []byte) {
+		return []byte("user"), []byte("pencil"), nil
+	}))
+	server := NewServer(ScramSha256, acceptAll, Tasks(pingTask), ScramCredentials(scramCredentials))
+
+	if names := server.Tasks(); !reflect.DeepEqual(names, []string{"PING"}) {
+		t.Errorf("Unexpected tasks: %v", names)
+	}
+	if err := server.BeginTask("PING"); err != ErrInvalidState {
+		t.Errorf("Unexpected error starting a task before the mechanism: want=%v, got=%v", ErrInvalidState, err)
+	}
+
+	if clientErr, serverErr := stepPair(client, server); clientErr != nil || serverErr != nil {
+		t.Fatalf("Unexpected error: client=%v, server=%v", clientErr, serverErr)
+	}
+
+	if err := server.BeginTask("NOPE"); err != ErrNoMechanism {
+		t.Errorf("Unexpected error starting an unknown task: want=%v, got=%v", ErrNoMechanism, err)
+	}
+	for _, n := range []*Negotiator{client, server} {
+		if err := n.BeginTask("PING"); err != nil {
+			t.Fatalf("Unexpected error starting task: %v", err)
+		}
+		if task := n.Task(); task != "PING" {
+			t.Errorf("Unexpected task: want=PING, got=%q", task)
+		}
+	}
+	if server.State() != Receiving|AuthTextSent {
+		t.Errorf("Unexpected server state after starting task: %b", server.State())
+	}
+
+	if clientErr, serverErr := stepPair(client, server); clientErr != nil || serverErr != nil {
+		t.Fatalf("Unexpected error during task: client=%v, server=%v", clientErr, serverErr)
+	}
+
+	// Resetting goes back to the original mechanism.
+	client.Reset()
+	server.Reset()
+	for _, n := range []*Negotiator{client, server} {
+		if task := n.Task(); task != "" {
+			t.Errorf("Unexpected task after reset: %q", task)
+		}
+	}
+	if clientErr, serverErr := stepPair(client, server); clientErr != nil || serverErr != nil {
+		t.Fatalf("Unexpected error after reset: client=%v, server=%v", clientErr, serverErr)
+	}
+}
+
+func TestAdditionalDataWithSuccess(t *testing.T) {
+	client := NewClient(ScramSha1, Credentials(func() ([]byte, []byte, []byte) {
+		return []byte("user"), []byte("pencil"), nil
+	}))
+	server := NewServer(ScramSha1, acceptAll, ScramCredentials(scramCredentials))
+
+	_, resp, err := client.Step(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, challenge, err := server.Step(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, resp, err = client.Step(challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	more, additional, err := server.Step(resp)
+	if err != nil || more || len(additional) == 0 {
+		t.Fatalf("Expected success with additional data: more=%v, data=%q, err=%v", more, additional, err)
+	}
+
+	// Without the additional data the client cannot verify the server.
+	more, _, err = client.Step(additional)
+	if err != nil || more {
+		t.Errorf("Unexpected result processing additional data: more=%v, err=%v", more, err)
+	}
+}
+
+func TestInlineFeaturesAndUserAgent(t *testing.T) {
+	const agentID = "d4565fa7-4d72-4749-b3d3-740edbf87770"
+	client := NewClient(Plain, InlineFeatures("bind2", "sm"), UserAgent(agentID, "Example Client", "Phone"))
+	if features := client.InlineFeatures(); !reflect.DeepEqual(features, []string{"bind2", "sm"}) {
+		t.Errorf("Unexpected inline features: %v", features)
+	}
+	if id, software, device := client.UserAgent(); id != agentID || software != "Example Client" || device != "Phone" {
+		t.Errorf("Unexpected user agent: %q, %q, %q", id, software, device)
+	}
+
+	// Tokens may be bound to the client that they were issued to.
+	tokens := func(n *Negotiator, _ string, username []byte) ([]byte, error) {
+		if id, _, _ := n.UserAgent(); string(username) != "user" || id != agentID {
+			return nil, nil
+		}
+		return []byte("token"), nil
+	}
+	for _, id := range []string{agentID, "", "52a2c8c2-58b0-4e4d-9e1c-95d2bbd1b4b4"} {
+		clientID := id
+		t.Run(id, func(t *testing.T) {
+			client := NewClient(HTSha256None, UserAgent(clientID, "", ""), Credentials(func() ([]byte, []byte, []byte) {
+				return []byte("user"), []byte("token"), nil
+			}))
+			server := NewServer(HTSha256None, acceptAll, UserAgent(clientID, "", ""), HTTokens(tokens))
+			var want error
+			if clientID != agentID {
+				want = ErrAuthn
+			}
+			if _, serverErr := stepPair(client, server); serverErr != want {
+				t.Errorf("Unexpected error: want=%v, got=%v", want, serverErr)
+			}
+		})
+	}
+}